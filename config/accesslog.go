@@ -0,0 +1,90 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type accessLogFormat string
+
+const (
+	// CombinedFormat is the Apache combined log format followed by the selected fields as key="value"
+	CombinedFormat = accessLogFormat("combined")
+	// JSONFormat writes the selected fields as one JSON object per line
+	JSONFormat = accessLogFormat("json")
+)
+
+// AccessLogFields are the fields that can be selected for the access log
+var AccessLogFields = []string{
+	"time", "request_id", "client", "method", "host", "path", "proto", "status",
+	"bytes_in", "bytes_out", "duration", "listener", "route", "upstream", "server",
+	"upstream_time", "error", "referer", "user_agent",
+}
+
+// combinedExtraFields are appended to the combined format when no fields are selected
+var combinedExtraFields = []string{"request_id", "upstream", "server", "upstream_time", "duration", "error"}
+
+// FileAccessLog is the accessLog section of the yml config file
+type FileAccessLog struct {
+	Disabled bool
+	// Format is combined or json, combined is used by default
+	Format string
+	Fields []string
+	// Output is empty when the access log is written to the main log output
+	FileLogOutput `yaml:",inline"`
+}
+
+type AccessLog struct {
+	Format accessLogFormat
+	Fields []string
+	// Output is nil when the access log is written to the main log output
+	Output *LogOutput
+}
+
+func (fa *FileAccessLog) validate() (*AccessLog, error) {
+	if fa == nil {
+		return &AccessLog{Format: CombinedFormat, Fields: combinedExtraFields}, nil
+	}
+	if fa.Disabled {
+		return nil, nil
+	}
+
+	al := &AccessLog{Format: accessLogFormat(strings.ToLower(fa.Format))}
+	switch al.Format {
+	case "":
+		al.Format = CombinedFormat
+	case CombinedFormat, JSONFormat:
+	default:
+		return nil, errors.Errorf("Unknown access log format %s", fa.Format)
+	}
+
+	known := make(map[string]bool, len(AccessLogFields))
+	for _, f := range AccessLogFields {
+		known[f] = true
+	}
+	for _, f := range fa.Fields {
+		if !known[f] {
+			return nil, errors.Errorf("Unknown access log field %s", f)
+		}
+	}
+	al.Fields = fa.Fields
+
+	if fa.Output != "" {
+		output, err := fa.FileLogOutput.validate("Access log", StdoutOutput)
+		if err != nil {
+			return nil, err
+		}
+		al.Output = output
+	} else if fa.File != "" || fa.Rotation != nil || fa.Syslog != nil {
+		return nil, errors.New("Access log output is required with file, rotation or syslog fields")
+	}
+
+	if len(al.Fields) == 0 {
+		al.Fields = AccessLogFields
+		if al.Format == CombinedFormat {
+			al.Fields = combinedExtraFields
+		}
+	}
+	return al, nil
+}
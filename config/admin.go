@@ -0,0 +1,126 @@
+package config
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// FileAdmin is the admin section of the yml config file
+type FileAdmin struct {
+	// Address is host:port or unix:///path of the admin API listener
+	// The reload and metrics endpoints stay on the listeners when it is empty
+	Address string
+	// Overlay is the file the server changes made with the admin API are saved to
+	Overlay string
+	// TLS serves the admin API over https, clients are authenticated with their certificates when clientCA is set
+	TLS *FileTLS `yaml:"tls"`
+
+	// Tokens are accepted in the Authorization: Bearer header, the keys are the caller names
+	Tokens map[string]string
+	// Users are accepted with the basic authentication, the keys are the user names
+	Users map[string]string
+	// Allow are the CIDRs of the clients allowed to use the admin endpoints
+	Allow []string
+	// Audit is the output of the audit log, the main log output is used by default
+	Audit *FileLogOutput
+}
+
+// Admin is the listener of the admin API, it is separate from the proxied traffic
+type Admin struct {
+	// Network and Address are empty when the admin API has no own listener
+	Network string
+	Address string
+	// Overlay is empty when the server changes are kept only in memory
+	Overlay string
+	TLS     *TLS
+
+	Tokens map[string]string
+	Users  map[string]string
+	// Allow is empty when the clients are not restricted by IP
+	Allow []*net.IPNet
+	// Audit is nil when the audit log is written to the main log output
+	Audit *LogOutput
+}
+
+// Authenticated reports whether the admin endpoints require the caller identity
+func (a *Admin) Authenticated() bool {
+	return len(a.Tokens) != 0 || len(a.Users) != 0 || (a.TLS != nil && a.TLS.ClientAuth != tls.NoClientCert)
+}
+
+func (fa *FileAdmin) validate(listeners []Listener) (*Admin, error) {
+	if fa == nil {
+		return nil, nil
+	}
+	admin := &Admin{Overlay: fa.Overlay, Tokens: fa.Tokens, Users: fa.Users}
+
+	if fa.Address != "" {
+		network, address, err := parseAddress(fa.Address)
+		if err != nil {
+			return nil, errors.Wrap(err, "Admin has invalid address")
+		}
+		for _, l := range listeners {
+			if addressesConflict(l.Network, l.Address, network, address) || (l.Redirect != nil && addressesConflict("tcp", l.Redirect.Address, network, address)) {
+				return nil, errors.Errorf("Admin address %s is already used by listener %s", fa.Address, l.Name)
+			}
+		}
+		admin.Network, admin.Address = network, address
+	} else if fa.TLS != nil || fa.Overlay != "" {
+		return nil, errors.New("Admin tls and overlay require the admin address")
+	}
+
+	if fa.TLS != nil {
+		t, err := fa.TLS.validate()
+		if err != nil {
+			return nil, errors.Wrap(err, "Admin has invalid tls section")
+		}
+		admin.TLS = t
+	}
+
+	for name, token := range fa.Tokens {
+		if name == "" || len(token) < 16 {
+			return nil, errors.Errorf("Admin token %q should be at least 16 characters long", name)
+		}
+	}
+	for name, password := range fa.Users {
+		if name == "" || password == "" {
+			return nil, errors.Errorf("Admin user %q should have name and password", name)
+		}
+	}
+
+	allow, err := parseCIDRs(fa.Allow)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid admin allow list")
+	}
+	admin.Allow = allow
+
+	if fa.Audit != nil {
+		audit, err := fa.Audit.validate("Admin audit", StderrOutput)
+		if err != nil {
+			return nil, err
+		}
+		admin.Audit = audit
+	}
+	return admin, nil
+}
+
+// CheckAdminChanges returns the error when the reloaded config changes the admin listener
+// Admin listener and the admin routes of the other listeners are set up on start
+func CheckAdminChanges(running, next *Admin) error {
+	var r, n Admin
+	if running != nil {
+		r = *running
+	}
+	if next != nil {
+		n = *next
+	}
+	if r.Network != n.Network || r.Address != n.Address {
+		return errors.New("Admin address can not be changed on reload, restart to apply it")
+	}
+	if !reflect.DeepEqual(r.TLS, n.TLS) {
+		return errors.New("Admin tls can not be changed on reload, restart to apply it")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestCheckAdminChanges(t *testing.T) {
+	running := &Admin{Network: "tcp", Address: "127.0.0.1:9000", TLS: &TLS{Certificates: []CertPair{{CertFile: "admin.crt", KeyFile: "admin.key"}}}}
+	changed := func(change func(a *Admin)) *Admin {
+		a := *running
+		tlsCopy := *running.TLS
+		a.TLS = &tlsCopy
+		change(&a)
+		return &a
+	}
+
+	tests := []struct {
+		name    string
+		running *Admin
+		next    *Admin
+		err     bool
+	}{
+		{name: "same listener", running: running, next: changed(func(a *Admin) {})},
+		{name: "tokens and users", running: running, next: changed(func(a *Admin) {
+			a.Tokens = map[string]string{"deploy": "0123456789abcdef0123"}
+			a.Users = map[string]string{"ops": "secret"}
+		})},
+		{name: "no admin section", running: nil, next: nil},
+		{name: "admin section without address", running: nil, next: &Admin{Tokens: map[string]string{"deploy": "0123456789abcdef0123"}}},
+		{name: "changed address", running: running, next: changed(func(a *Admin) { a.Address = "127.0.0.1:9001" }), err: true},
+		{name: "changed network", running: running, next: changed(func(a *Admin) { a.Network, a.Address = "unix", "/run/admin.sock" }), err: true},
+		{name: "changed tls", running: running, next: changed(func(a *Admin) { a.TLS.ClientAuth = tls.RequireAndVerifyClientCert }), err: true},
+		{name: "removed tls", running: running, next: changed(func(a *Admin) { a.TLS = nil }), err: true},
+		{name: "added address", running: nil, next: &Admin{Network: "tcp", Address: "127.0.0.1:9000"}, err: true},
+		{name: "removed address", running: running, next: &Admin{}, err: true},
+		{name: "removed admin section", running: running, next: nil, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckAdminChanges(tt.running, tt.next)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
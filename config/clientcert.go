@@ -0,0 +1,43 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// ClientCertificate returns the verified client certificate of the request
+// Certificates that were not verified against the listener clientCA are ignored
+func ClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// CertSANs returns all the subject alternative names of the certificate
+func CertSANs(c *x509.Certificate) []string {
+	sans := make([]string, 0, len(c.DNSNames)+len(c.EmailAddresses)+len(c.IPAddresses)+len(c.URIs))
+	sans = append(sans, c.DNSNames...)
+	sans = append(sans, c.EmailAddresses...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range c.URIs {
+		sans = append(sans, u.String())
+	}
+	return sans
+}
+
+// CertFingerprint returns lowercase hex SHA-256 of the DER encoded certificate
+func CertFingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint allows to write fingerprints in the config the way openssl prints them: AB:CD:...
+func normalizeFingerprint(f string) string {
+	return strings.ToLower(strings.Replace(f, ":", "", -1))
+}
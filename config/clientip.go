@@ -0,0 +1,29 @@
+package config
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type clientIPKeyType int
+
+var clientIPKey clientIPKeyType = 0
+
+// ContextWithClientIP stores the resolved client IP, so it can be used by the conditions
+func ContextWithClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIP returns the client IP resolved from the trusted proxies headers
+// IP of the connection peer is used when the request was not processed by the proxy middleware
+func ClientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey).(net.IP); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		resolved net.IP
+		want     string
+	}{
+		{name: "resolved address is preferred", remote: "10.0.0.1:4000", resolved: net.ParseIP("203.0.113.7"), want: "203.0.113.7"},
+		{name: "peer address", remote: "10.0.0.1:4000", want: "10.0.0.1"},
+		{name: "ipv6 peer address", remote: "[2001:db8::1]:4000", want: "2001:db8::1"},
+		{name: "unix socket peer", remote: "@", want: "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			if tt.resolved != nil {
+				r = r.WithContext(ContextWithClientIP(r.Context(), tt.resolved))
+			}
+			if got := ClientIP(r); got.String() != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateClientIPCondition(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "single address", value: "10.0.0.1"},
+		{name: "cidr list", value: "10.0.0.0/8, 2001:db8::/32"},
+		{name: "invalid address", value: "10.0.0.300", wantErr: true},
+		{name: "invalid cidr", value: "10.0.0.0/33", wantErr: true},
+		{name: "empty list", value: " , ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateCondition("internal", "clientip", "", tt.value)
+			if tt.wantErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -24,10 +26,22 @@ const (
 	RegexpCond    = conditionType("regexp")
 	HasHeaderCond = conditionType("hasheader")
 	HeaderCond    = conditionType("header")
+
+	ClientCertSubjectCond     = conditionType("clientcertsubject")
+	ClientCertSANCond         = conditionType("clientcertsan")
+	ClientCertFingerprintCond = conditionType("clientcertfingerprint")
+
+	GRPCServiceCond = conditionType("grpcservice")
+	GRPCMethodCond  = conditionType("grpcmethod")
+
+	ClientIPCond = conditionType("clientip")
 )
 
 var validCondTypes = map[conditionType]bool{
 	PrefixCond: true, RegexpCond: true, HasHeaderCond: true, HeaderCond: true,
+	ClientCertSubjectCond: true, ClientCertSANCond: true, ClientCertFingerprintCond: true,
+	GRPCServiceCond: true, GRPCMethodCond: true,
+	ClientIPCond: true,
 }
 
 func GetConditionType(t string) (conditionType, error) {
@@ -42,6 +56,16 @@ func GetConditionType(t string) (conditionType, error) {
 
 type Condition interface {
 	Check(r *http.Request) bool
+	// Explain describes the part of the request the condition is checked against
+	Explain(r *http.Request) string
+}
+
+// matchWord is used in the explanations of the conditions
+func matchWord(ok bool) string {
+	if ok {
+		return "matches"
+	}
+	return "does not match"
 }
 
 type PrefixCondition struct {
@@ -52,6 +76,10 @@ func (c *PrefixCondition) Check(r *http.Request) bool {
 	return strings.HasPrefix(r.RequestURI, c.prefix)
 }
 
+func (c *PrefixCondition) Explain(r *http.Request) string {
+	return fmt.Sprintf("request URI %q %s prefix %q", r.RequestURI, matchWord(c.Check(r)), c.prefix)
+}
+
 type RegexpCondition struct {
 	reg *regexp.Regexp
 }
@@ -60,6 +88,10 @@ func (c *RegexpCondition) Check(r *http.Request) bool {
 	return c.reg.MatchString(r.RequestURI)
 }
 
+func (c *RegexpCondition) Explain(r *http.Request) string {
+	return fmt.Sprintf("request URI %q %s regexp %q", r.RequestURI, matchWord(c.Check(r)), c.reg)
+}
+
 type HasHeaderCondition struct {
 	header string
 }
@@ -68,6 +100,13 @@ func (c *HasHeaderCondition) Check(r *http.Request) bool {
 	return len(r.Header.Get(c.header)) != 0
 }
 
+func (c *HasHeaderCondition) Explain(r *http.Request) string {
+	if c.Check(r) {
+		return fmt.Sprintf("header %s is present", c.header)
+	}
+	return fmt.Sprintf("header %s is missing or empty", c.header)
+}
+
 type HeaderValueCondition struct {
 	header string
 	value  string
@@ -77,6 +116,178 @@ func (c *HeaderValueCondition) Check(r *http.Request) bool {
 	return strings.EqualFold(r.Header.Get(c.header), c.value)
 }
 
+func (c *HeaderValueCondition) Explain(r *http.Request) string {
+	if _, ok := r.Header[http.CanonicalHeaderKey(c.header)]; !ok {
+		return fmt.Sprintf("header %s is missing, expected %q", c.header, c.value)
+	}
+	return fmt.Sprintf("header %s value %q %s %q", c.header, r.Header.Get(c.header), matchWord(c.Check(r)), c.value)
+}
+
+const noClientCert = "no verified client certificate"
+
+// ClientCertSubjectCondition matches the subject of the verified client certificate, e.g. `CN=client,O=Org`
+type ClientCertSubjectCondition struct {
+	subject string
+}
+
+func (c *ClientCertSubjectCondition) Check(r *http.Request) bool {
+	cert := ClientCertificate(r)
+	return cert != nil && strings.EqualFold(cert.Subject.String(), c.subject)
+}
+
+func (c *ClientCertSubjectCondition) Explain(r *http.Request) string {
+	cert := ClientCertificate(r)
+	if cert == nil {
+		return noClientCert
+	}
+	return fmt.Sprintf("client certificate subject %q %s %q", cert.Subject.String(), matchWord(c.Check(r)), c.subject)
+}
+
+// ClientCertSANCondition matches if any of the verified client certificate SANs is equal to the value
+type ClientCertSANCondition struct {
+	san string
+}
+
+func (c *ClientCertSANCondition) Check(r *http.Request) bool {
+	cert := ClientCertificate(r)
+	if cert == nil {
+		return false
+	}
+	for _, san := range CertSANs(cert) {
+		if strings.EqualFold(san, c.san) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientCertSANCondition) Explain(r *http.Request) string {
+	cert := ClientCertificate(r)
+	if cert == nil {
+		return noClientCert
+	}
+	if c.Check(r) {
+		return fmt.Sprintf("client certificate has SAN %q", c.san)
+	}
+	return fmt.Sprintf("client certificate SANs %q do not include %q", CertSANs(cert), c.san)
+}
+
+// ClientCertFingerprintCondition matches the SHA-256 fingerprint of the verified client certificate
+type ClientCertFingerprintCondition struct {
+	fingerprint string
+}
+
+func (c *ClientCertFingerprintCondition) Check(r *http.Request) bool {
+	cert := ClientCertificate(r)
+	return cert != nil && CertFingerprint(cert) == c.fingerprint
+}
+
+func (c *ClientCertFingerprintCondition) Explain(r *http.Request) string {
+	cert := ClientCertificate(r)
+	if cert == nil {
+		return noClientCert
+	}
+	return fmt.Sprintf("client certificate fingerprint %s %s %s", CertFingerprint(cert), matchWord(c.Check(r)), c.fingerprint)
+}
+
+// IsGRPC reports whether the request is made by gRPC client
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcServiceMethod splits the gRPC request path `/package.Service/Method` into service and method
+func grpcServiceMethod(r *http.Request) (string, string, bool) {
+	if !IsGRPC(r) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// explainGRPC describes why the request is not a gRPC call, the string is empty when it is
+func explainGRPC(r *http.Request) string {
+	if !IsGRPC(r) {
+		return fmt.Sprintf("not a gRPC request, content type is %q", r.Header.Get("Content-Type"))
+	}
+	if _, _, ok := grpcServiceMethod(r); !ok {
+		return fmt.Sprintf("path %q is not a gRPC method", r.URL.Path)
+	}
+	return ""
+}
+
+// GRPCServiceCondition matches gRPC requests to the fully qualified service, e.g. `helloworld.Greeter`
+type GRPCServiceCondition struct {
+	service string
+}
+
+func (c *GRPCServiceCondition) Check(r *http.Request) bool {
+	service, _, ok := grpcServiceMethod(r)
+	return ok && service == c.service
+}
+
+func (c *GRPCServiceCondition) Explain(r *http.Request) string {
+	if reason := explainGRPC(r); reason != "" {
+		return reason
+	}
+	service, _, _ := grpcServiceMethod(r)
+	return fmt.Sprintf("gRPC service %s %s %s", service, matchWord(c.Check(r)), c.service)
+}
+
+// GRPCMethodCondition matches gRPC requests to the method of the service, e.g. `helloworld.Greeter/SayHello`
+type GRPCMethodCondition struct {
+	service string
+	method  string
+}
+
+func (c *GRPCMethodCondition) Check(r *http.Request) bool {
+	service, method, ok := grpcServiceMethod(r)
+	return ok && service == c.service && method == c.method
+}
+
+func (c *GRPCMethodCondition) Explain(r *http.Request) string {
+	if reason := explainGRPC(r); reason != "" {
+		return reason
+	}
+	service, method, _ := grpcServiceMethod(r)
+	return fmt.Sprintf("gRPC method %s/%s %s %s/%s", service, method, matchWord(c.Check(r)), c.service, c.method)
+}
+
+// ClientIPCondition matches the resolved client IP against the comma separated list of CIDRs
+type ClientIPCondition struct {
+	nets []*net.IPNet
+}
+
+func (c *ClientIPCondition) Check(r *http.Request) bool {
+	ip := ClientIP(r)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ClientIPCondition) Explain(r *http.Request) string {
+	ip := ClientIP(r)
+	if ip == nil {
+		return "client IP is unknown"
+	}
+	nets := make([]string, len(c.nets))
+	for i, n := range c.nets {
+		nets[i] = n.String()
+	}
+	if c.Check(r) {
+		return fmt.Sprintf("client IP %s is in %s", ip, strings.Join(nets, ", "))
+	}
+	return fmt.Sprintf("client IP %s is not in %s", ip, strings.Join(nets, ", "))
+}
+
 func GetCondition(t conditionType, key, value string) Condition {
 	switch t {
 	case PrefixCond:
@@ -93,6 +304,30 @@ func GetCondition(t conditionType, key, value string) Condition {
 		return &HasHeaderCondition{header: value}
 	case HeaderCond:
 		return &HeaderValueCondition{header: key, value: value}
+	case ClientCertSubjectCond:
+		return &ClientCertSubjectCondition{subject: value}
+	case ClientCertSANCond:
+		return &ClientCertSANCondition{san: value}
+	case ClientCertFingerprintCond:
+		return &ClientCertFingerprintCondition{fingerprint: normalizeFingerprint(value)}
+	case GRPCServiceCond:
+		return &GRPCServiceCondition{service: strings.Trim(value, "/")}
+	case GRPCMethodCond:
+		{
+			parts := strings.Split(strings.Trim(value, "/"), "/")
+			if len(parts) != 2 {
+				return nil
+			}
+			return &GRPCMethodCondition{service: parts[0], method: parts[1]}
+		}
+	case ClientIPCond:
+		{
+			nets, err := parseCIDRs(splitList(value))
+			if err != nil {
+				return nil
+			}
+			return &ClientIPCondition{nets: nets}
+		}
 	}
 	return nil
 }
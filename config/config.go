@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"net"
 	"net/url"
 	"regexp"
 	"strings"
@@ -17,16 +18,81 @@ type FileConfig struct {
 	ServerReadTimeout  int `yaml:"serverReadTimeout"`
 	ServerWriteTimeout int `yaml:"serverWriteTimeout"`
 	ProxyTimeout       int `yaml:"proxyTimeout"`
+	// TrustedProxies are the CIDRs of the proxies in front of the balancer,
+	// their X-Forwarded-For and Forwarded headers are used to find the client IP
+	TrustedProxies []string `yaml:"trustedProxies"`
 
-	Upstreams map[string]struct {
-		Servers []string
+	Logging   *FileLogging
+	AccessLog *FileAccessLog `yaml:"accessLog"`
+	Tracing   *FileTracing
+	RequestID *FileRequestID `yaml:"requestId"`
+	Admin     *FileAdmin
 
-		Condition struct {
-			Type  string
-			Key   string
-			Value string
+	Listeners []FileListener
+
+	Upstreams upstreamList
+}
+
+// FileUpstream is the upstream section of the yml config file
+type FileUpstream struct {
+	Servers []FileServer
+
+	Condition struct {
+		Type  string
+		Key   string
+		Value string
+	}
+
+	TLS *FileUpstreamTLS `yaml:"tls"`
+	// Protocol is one of http1, h2 or h2c, empty means negotiate h2 over TLS when possible
+	Protocol string
+
+	HealthCheck *FileHealthCheck `yaml:"healthCheck"`
+	// HostHeader is preserve, upstream or the literal value sent to the servers
+	HostHeader string `yaml:"hostHeader"`
+	// StripPrefix is removed from the request path before it is sent to the servers
+	// It applies to every route of the upstream, the rewritten responses get it back
+	StripPrefix string `yaml:"stripPrefix"`
+	// RewriteResponses maps the server URLs in Location, Content-Location and Set-Cookie
+	RewriteResponses bool `yaml:"rewriteResponses"`
+
+	// MinHealthyPercent is the share of healthy servers the tier needs to receive the traffic
+	MinHealthyPercent int `yaml:"minHealthyPercent"`
+	// Spillover is the upstream used when none of the tiers has enough healthy servers
+	Spillover string
+	// Critical upstreams without healthy servers make the balancer not ready
+	Critical bool
+}
+
+type namedUpstream struct {
+	Name string
+	FileUpstream
+}
+
+// upstreamList keeps the upstreams in the order they are declared in the config file,
+// so the routes are matched in a predictable order
+type upstreamList []namedUpstream
+
+func (ul *upstreamList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var keys yaml.MapSlice
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+	var values map[string]FileUpstream
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+
+	list := make(upstreamList, 0, len(keys))
+	for _, item := range keys {
+		name, ok := item.Key.(string)
+		if !ok {
+			return errors.Errorf("Upstream name %v should be a string", item.Key)
 		}
+		list = append(list, namedUpstream{Name: name, FileUpstream: values[name]})
 	}
+	*ul = list
+	return nil
 }
 
 type Cond struct {
@@ -39,6 +105,55 @@ type Upstr struct {
 	Name      string
 	Servers   []url.URL
 	Condition Cond
+	// TLS is used for the https servers of the upstream
+	TLS      *UpstreamTLS
+	Protocol upstreamProtocol
+	// HealthCheck is nil when the servers are not probed
+	HealthCheck *HealthCheck
+	// HostHeader is PreserveHost, UpstreamHost or the literal host
+	HostHeader       string
+	StripPrefix      string
+	RewriteResponses bool
+	// Priorities of the Servers, the servers with the lowest value are used first
+	Priorities []int
+	// Weights of the Servers, the share of the requests within the same priority
+	Weights           []int
+	MinHealthyPercent int
+	Spillover         string
+	Critical          bool
+}
+
+const (
+	// PreserveHost passes the Host of the client request
+	PreserveHost = "preserve"
+	// UpstreamHost uses the host:port of the selected server
+	UpstreamHost = "upstream"
+)
+
+func validateHostHeader(uname, value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", PreserveHost:
+		return PreserveHost, nil
+	case UpstreamHost:
+		return UpstreamHost, nil
+	}
+	if strings.ContainsAny(value, " \t\r\n/") {
+		return "", errors.Errorf("Upstream %s has invalid hostHeader %q", uname, value)
+	}
+	return value, nil
+}
+
+type upstreamProtocol string
+
+const (
+	AutoProtocol  = upstreamProtocol("")
+	HTTP1Protocol = upstreamProtocol("http1")
+	H2Protocol    = upstreamProtocol("h2")
+	H2CProtocol   = upstreamProtocol("h2c")
+)
+
+var validUpstreamProtocols = map[upstreamProtocol]bool{
+	AutoProtocol: true, HTTP1Protocol: true, H2Protocol: true, H2CProtocol: true,
 }
 
 type Config struct {
@@ -46,15 +161,30 @@ type Config struct {
 	ServerReadTimeout  int
 	ServerWriteTimeout int
 	ProxyTimeout       int
-	Upstreams          []Upstr
+	TrustedProxies     []*net.IPNet
+	Logging            *Logging
+	// AccessLog is nil when the access log is disabled
+	AccessLog *AccessLog
+	// Tracing is nil when the spans are not exported
+	Tracing   *Tracing
+	RequestID *RequestID
+	// Admin is nil when the admin endpoints are served by the listeners
+	Admin     *Admin
+	Listeners []Listener
+	Upstreams []Upstr
 }
 
 func (fc FileConfig) validate() (*Config, error) {
 	conf := Config{}
 
-	// TODO: check for 0/to big port
-	if fc.Port <= 0 || fc.Port > 65536 {
-		return nil, errors.Errorf("Invalid Port value %v", fc.Port)
+	// The single port is kept for the configs that were written before the listeners were introduced
+	if len(fc.Listeners) == 0 {
+		// TODO: check for 0/to big port
+		if fc.Port <= 0 || fc.Port > 65536 {
+			return nil, errors.Errorf("Invalid Port value %v", fc.Port)
+		}
+	} else if fc.Port != 0 {
+		return nil, errors.New("Port can not be used together with listeners")
 	}
 	conf.Port = fc.Port
 	// TODO: find a better way to copy this values
@@ -62,63 +192,261 @@ func (fc FileConfig) validate() (*Config, error) {
 	conf.ServerWriteTimeout = fc.ServerWriteTimeout
 	conf.ProxyTimeout = fc.ProxyTimeout
 
+	trusted, err := parseCIDRs(fc.TrustedProxies)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid trustedProxies")
+	}
+	conf.TrustedProxies = trusted
+
+	logging, err := fc.Logging.validate()
+	if err != nil {
+		return nil, err
+	}
+	conf.Logging = logging
+
+	accessLog, err := fc.AccessLog.validate()
+	if err != nil {
+		return nil, err
+	}
+	conf.AccessLog = accessLog
+
+	tracing, err := fc.Tracing.validate()
+	if err != nil {
+		return nil, err
+	}
+	conf.Tracing = tracing
+
+	requestID, err := fc.RequestID.validate()
+	if err != nil {
+		return nil, err
+	}
+	if requestID.Trust == TrustProxies && len(conf.TrustedProxies) == 0 {
+		return nil, errors.New("requestId trust proxies requires trustedProxies")
+	}
+	conf.RequestID = requestID
+
 	// TODO: validate host name
 	// TODO: what rules should we apply?
 	// No path?
 	// Scheme is optional?
-	for uname, ups := range fc.Upstreams {
+	for _, ups := range fc.Upstreams {
+		uname := ups.Name
 		var sURLs []url.URL
 
 		if len(ups.Servers) == 0 {
 			return nil, errors.Errorf("Upstream %s should have at least one server", uname)
 		}
 
-		for _, s := range ups.Servers {
-			// TODO: find a better way to do this
-			if !strings.HasPrefix(s, "http") {
-				s = "http://" + s
-			}
-			u, err := url.Parse(s)
-			if err != nil || u.Hostname() == "" || u.Port() == "" {
-				return nil, errors.Errorf("%s is not a valid host for upstream %s : %s", s, uname, err)
+		for _, fs := range ups.Servers {
+			u, err := ParseServer(fs.URL)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Upstream %s", uname)
 			}
 			sURLs = append(sURLs, *u)
 		}
 
-		// TODO: check if type is in the known list
-		cond := ups.Condition
-		if cond.Type == "" {
-			return nil, errors.Errorf("Upstream %s condition is missing the type field", uname)
+		// Upstreams without condition can be used only by tcp and udp listeners
+		var parsedCond Cond
+		if cond := ups.Condition; cond.Type != "" || cond.Key != "" || cond.Value != "" {
+			c, err := validateCondition(uname, cond.Type, cond.Key, cond.Value)
+			if err != nil {
+				return nil, err
+			}
+			parsedCond = *c
 		}
 
-		if cond.Value == "" {
-			return nil, errors.Errorf("Upstream %s condition is missing the value field", uname)
-		}
+		upstr := Upstr{Name: uname, Servers: sURLs, Condition: parsedCond}
 
-		ct, err := GetConditionType(cond.Type)
-		if err != nil {
-			// TODO: wrap with upstream info
-			return nil, errors.Errorf("Invalid condition type for upstream %s: %s", uname, err)
+		if ups.TLS != nil {
+			if !hasHTTPSServer(sURLs) {
+				return nil, errors.Errorf("Upstream %s has tls section, but none of its servers use https", uname)
+			}
+			t, err := ups.TLS.validate()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Upstream %s has invalid tls section", uname)
+			}
+			upstr.TLS = t
 		}
-		parsedCond := Cond{Type: ct, Key: cond.Key, Value: cond.Value}
 
-		if ct == HeaderCond && cond.Key == "" {
-			return nil, errors.Errorf("Upstream %s condition is missing the key field", uname)
+		upstr.Protocol = upstreamProtocol(strings.ToLower(ups.Protocol))
+		if !validUpstreamProtocols[upstr.Protocol] {
+			return nil, errors.Errorf("Upstream %s has invalid protocol %s", uname, ups.Protocol)
+		}
+		for _, u := range sURLs {
+			if err := upstr.CheckServer(u); err != nil {
+				return nil, err
+			}
 		}
 
-		if ct == RegexpCond {
-			_, err := regexp.Compile(cond.Value)
+		if ups.HealthCheck != nil {
+			hc, err := ups.HealthCheck.validate()
 			if err != nil {
-				return nil, errors.Errorf("Upstream %s condition value is not a valid regexp", uname)
+				return nil, errors.Wrapf(err, "Upstream %s has invalid healthCheck section", uname)
+			}
+			// gRPC runs only over HTTP/2
+			if hc.Type == GRPCHealthCheck && upstr.Protocol != H2Protocol && upstr.Protocol != H2CProtocol {
+				return nil, errors.Errorf("Upstream %s grpc health check requires h2 or h2c protocol", uname)
 			}
+			upstr.HealthCheck = hc
 		}
 
-		upstr := Upstr{Name: uname, Servers: sURLs, Condition: parsedCond}
+		hostHeader, err := validateHostHeader(uname, ups.HostHeader)
+		if err != nil {
+			return nil, err
+		}
+		upstr.HostHeader = hostHeader
+
+		if p := ups.StripPrefix; p != "" {
+			upstr.StripPrefix = strings.TrimSuffix(p, "/")
+			if !strings.HasPrefix(p, "/") || upstr.StripPrefix == "" {
+				return nil, errors.Errorf("Upstream %s has invalid stripPrefix %s", uname, p)
+			}
+		}
+		upstr.RewriteResponses = ups.RewriteResponses
+
+		priorities, err := serverPriorities(uname, ups.Servers)
+		if err != nil {
+			return nil, err
+		}
+		upstr.Priorities = priorities
+		weights, err := serverWeights(uname, ups.Servers)
+		if err != nil {
+			return nil, err
+		}
+		upstr.Weights = weights
+		if ups.MinHealthyPercent < 0 || ups.MinHealthyPercent > 100 {
+			return nil, errors.Errorf("Upstream %s minHealthyPercent should be between 0 and 100", uname)
+		}
+		upstr.MinHealthyPercent = ups.MinHealthyPercent
+		upstr.Spillover = ups.Spillover
+		upstr.Critical = ups.Critical
 		conf.Upstreams = append(conf.Upstreams, upstr)
 	}
+
+	if err := validateSpillover(conf.Upstreams); err != nil {
+		return nil, err
+	}
+
+	listeners, err := fc.validateListeners(conf.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	conf.Listeners = listeners
+
+	admin, err := fc.Admin.validate(listeners)
+	if err != nil {
+		return nil, err
+	}
+	conf.Admin = admin
+
+	if err := validateLogFiles(&conf); err != nil {
+		return nil, err
+	}
 	return &conf, nil
 }
 
+func validateCondition(uname, t, key, value string) (*Cond, error) {
+	// TODO: check if type is in the known list
+	if t == "" {
+		return nil, errors.Errorf("Upstream %s condition is missing the type field", uname)
+	}
+
+	if value == "" {
+		return nil, errors.Errorf("Upstream %s condition is missing the value field", uname)
+	}
+
+	ct, err := GetConditionType(t)
+	if err != nil {
+		// TODO: wrap with upstream info
+		return nil, errors.Errorf("Invalid condition type for upstream %s: %s", uname, err)
+	}
+	parsedCond := Cond{Type: ct, Key: key, Value: value}
+
+	if ct == HeaderCond && key == "" {
+		return nil, errors.Errorf("Upstream %s condition is missing the key field", uname)
+	}
+
+	if ct == RegexpCond {
+		_, err := regexp.Compile(value)
+		if err != nil {
+			return nil, errors.Errorf("Upstream %s condition value is not a valid regexp", uname)
+		}
+	}
+
+	if ct == GRPCMethodCond && len(strings.Split(strings.Trim(value, "/"), "/")) != 2 {
+		return nil, errors.Errorf("Upstream %s condition value should be in form of package.Service/Method", uname)
+	}
+
+	if ct == ClientIPCond {
+		nets, err := parseCIDRs(splitList(value))
+		if err != nil || len(nets) == 0 {
+			return nil, errors.Errorf("Upstream %s condition value should be the list of IP addresses or CIDRs", uname)
+		}
+	}
+	return &parsedCond, nil
+}
+
+// ParseServer parses the server address, http scheme is used when it is omitted
+func ParseServer(s string) (*url.URL, error) {
+	if strings.HasPrefix(s, unixServerPrefix) {
+		u, err := parseUnixServer(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s is not a valid server", s)
+		}
+		return u, nil
+	}
+	// TODO: find a better way to do this
+	if !strings.HasPrefix(s, "http") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" || u.Port() == "" {
+		return nil, errors.Errorf("%s is not a valid host : %v", s, err)
+	}
+	return u, nil
+}
+
+// CheckServer reports whether the server can be used with the upstream protocol
+func (u Upstr) CheckServer(s url.URL) error {
+	// h2 is negotiated with ALPN and h2c is the HTTP/2 over cleartext
+	if (u.Protocol == H2Protocol && s.Scheme != "https") || (u.Protocol == H2CProtocol && s.Scheme == "https") {
+		return errors.Errorf("Upstream %s protocol %s can not be used with %s server", u.Name, u.Protocol, s.String())
+	}
+	return nil
+}
+
+// unixServerPrefix marks the servers listening on unix domain sockets, e.g. unix:///run/app.sock
+const unixServerPrefix = "unix://"
+
+// parseUnixServer returns URL with unix scheme and the socket path
+// Plain HTTP is used over the socket
+func parseUnixServer(s string) (*url.URL, error) {
+	path := strings.TrimPrefix(s, unixServerPrefix)
+	if path == "" || strings.ContainsAny(path, "?#") {
+		return nil, errors.New("Socket path is missing or invalid")
+	}
+	return &url.URL{Scheme: "unix", Path: path}, nil
+}
+
+// hasUnixServer reports whether any server listens on the unix socket
+func hasUnixServer(servers []url.URL) bool {
+	for _, s := range servers {
+		if s.Scheme == "unix" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasHTTPSServer(servers []url.URL) bool {
+	for _, s := range servers {
+		if s.Scheme == "https" {
+			return true
+		}
+	}
+	return false
+}
+
 func ReadConfig(path string) (*Config, error) {
 	// TODO: Check the correct way to read files
 	source, err := ioutil.ReadFile(path)
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+)
+
+// FileServer is the server entry of the upstream
+// It is either the plain server address or the mapping with the url and failover options
+type FileServer struct {
+	URL string `yaml:"url"`
+	// Backup servers receive the traffic only when the other servers are not enough
+	Backup bool
+	// Priority groups the servers into tiers, the lower values are used first
+	Priority int
+	// Weight is the share of the requests the server receives within its tier, 1 by default
+	Weight int
+}
+
+func (fs *FileServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*fs = FileServer{URL: address}
+		return nil
+	}
+	type plain FileServer
+	return unmarshal((*plain)(fs))
+}
+
+// serverPriorities returns the priorities of the servers in the same order
+// Backup servers get the priority after all the other ones
+func serverPriorities(uname string, servers []FileServer) ([]int, error) {
+	max := 0
+	for _, s := range servers {
+		if s.Priority < 0 {
+			return nil, errors.Errorf("Upstream %s server %s priority should not be negative", uname, s.URL)
+		}
+		if s.Backup && s.Priority != 0 {
+			return nil, errors.Errorf("Upstream %s server %s can not have both backup and priority", uname, s.URL)
+		}
+		if s.Priority > max {
+			max = s.Priority
+		}
+	}
+
+	priorities := make([]int, 0, len(servers))
+	for _, s := range servers {
+		if s.Backup {
+			priorities = append(priorities, max+1)
+			continue
+		}
+		priorities = append(priorities, s.Priority)
+	}
+	return priorities, nil
+}
+
+// MaxWeight limits the server weight, so the weighted round robin counters do not overflow
+const MaxWeight = 1000
+
+// ValidateWeight returns the weight of the server, 0 means the default one
+func ValidateWeight(weight int) (int, error) {
+	if weight < 0 || weight > MaxWeight {
+		return 0, errors.Errorf("Server weight should be between 1 and %d", MaxWeight)
+	}
+	if weight == 0 {
+		return 1, nil
+	}
+	return weight, nil
+}
+
+// serverWeights returns the weights of the servers in the same order
+func serverWeights(uname string, servers []FileServer) ([]int, error) {
+	weights := make([]int, 0, len(servers))
+	for _, s := range servers {
+		w, err := ValidateWeight(s.Weight)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Upstream %s server %s", uname, s.URL)
+		}
+		weights = append(weights, w)
+	}
+	return weights, nil
+}
+
+// validateSpillover checks the spillover upstreams exist once all the upstreams are parsed
+func validateSpillover(upstreams []Upstr) error {
+	known := make(map[string]bool, len(upstreams))
+	for _, u := range upstreams {
+		known[u.Name] = true
+	}
+	for _, u := range upstreams {
+		if u.Spillover == "" {
+			continue
+		}
+		if u.Spillover == u.Name {
+			return errors.Errorf("Upstream %s can not spill over to itself", u.Name)
+		}
+		if !known[u.Spillover] {
+			return errors.Errorf("Upstream %s refers to the unknown spillover upstream %s", u.Name, u.Spillover)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServerPriorities(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []FileServer
+		want    []int
+		err     bool
+	}{
+		{
+			name:    "default priority",
+			servers: []FileServer{{URL: "a"}, {URL: "b"}},
+			want:    []int{0, 0},
+		},
+		{
+			name:    "backup goes after the lowest priority",
+			servers: []FileServer{{URL: "a"}, {URL: "b", Priority: 2}, {URL: "c", Backup: true}},
+			want:    []int{0, 2, 3},
+		},
+		{
+			name:    "backup without priorities",
+			servers: []FileServer{{URL: "a"}, {URL: "b", Backup: true}},
+			want:    []int{0, 1},
+		},
+		{
+			name:    "backup with priority",
+			servers: []FileServer{{URL: "a"}, {URL: "b", Backup: true, Priority: 1}},
+			err:     true,
+		},
+		{
+			name:    "negative priority",
+			servers: []FileServer{{URL: "a", Priority: -1}},
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := serverPriorities("api", tt.servers)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateWeight(t *testing.T) {
+	tests := []struct {
+		weight int
+		want   int
+		err    bool
+	}{
+		{weight: 0, want: 1},
+		{weight: 5, want: 5},
+		{weight: MaxWeight, want: MaxWeight},
+		{weight: MaxWeight + 1, err: true},
+		{weight: -1, err: true},
+	}
+	for _, tt := range tests {
+		got, err := ValidateWeight(tt.weight)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ValidateWeight(%d): expected %d with error %v, got %d %v", tt.weight, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestValidateSpillover(t *testing.T) {
+	tests := []struct {
+		name      string
+		upstreams []Upstr
+		err       bool
+	}{
+		{name: "known spillover", upstreams: []Upstr{{Name: "api", Spillover: "backup"}, {Name: "backup"}}},
+		{name: "unknown spillover", upstreams: []Upstr{{Name: "api", Spillover: "backup"}}, err: true},
+		{name: "spillover to itself", upstreams: []Upstr{{Name: "api", Spillover: "api"}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSpillover(tt.upstreams); (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
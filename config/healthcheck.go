@@ -0,0 +1,98 @@
+package config
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type healthCheckType string
+
+const (
+	HTTPHealthCheck = healthCheckType("http")
+	GRPCHealthCheck = healthCheckType("grpc")
+	// TCPHealthCheck only checks that the connection can be established
+	TCPHealthCheck = healthCheckType("tcp")
+)
+
+var validHealthCheckTypes = map[healthCheckType]bool{
+	HTTPHealthCheck: true, GRPCHealthCheck: true, TCPHealthCheck: true,
+}
+
+// FileHealthCheck is the healthCheck section of the upstream in the yml config file
+// Interval and timeout are set in seconds
+type FileHealthCheck struct {
+	Type string
+	// Path is used by http checks
+	Path string
+	// Service is used by grpc checks, empty value checks the overall server health
+	Service            string
+	Interval           int
+	Timeout            int
+	HealthyThreshold   int `yaml:"healthyThreshold"`
+	UnhealthyThreshold int `yaml:"unhealthyThreshold"`
+}
+
+// HealthCheck describes the active probing of the upstream servers
+type HealthCheck struct {
+	Type     healthCheckType
+	Path     string
+	Service  string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Number of consecutive successful/failed probes required to change the server state
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+func (fh *FileHealthCheck) validate() (*HealthCheck, error) {
+	hc := HealthCheck{
+		Type:               healthCheckType(strings.ToLower(fh.Type)),
+		Path:               fh.Path,
+		Service:            fh.Service,
+		Interval:           time.Duration(fh.Interval) * time.Second,
+		Timeout:            time.Duration(fh.Timeout) * time.Second,
+		HealthyThreshold:   fh.HealthyThreshold,
+		UnhealthyThreshold: fh.UnhealthyThreshold,
+	}
+	if hc.Type == "" {
+		hc.Type = HTTPHealthCheck
+	}
+	if !validHealthCheckTypes[hc.Type] {
+		return nil, errors.Errorf("Unknown health check type %s", fh.Type)
+	}
+
+	if hc.Type == HTTPHealthCheck {
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if !strings.HasPrefix(hc.Path, "/") {
+			return nil, errors.Errorf("Health check path %s should start with /", hc.Path)
+		}
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return nil, errors.New("Health check interval and timeout should be positive")
+	}
+	if hc.Timeout > hc.Interval {
+		return nil, errors.New("Health check timeout should not exceed the interval")
+	}
+
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+	if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return nil, errors.New("Health check thresholds should be positive")
+	}
+	return &hc, nil
+}
@@ -0,0 +1,411 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type listenerProtocol string
+
+const (
+	HTTPProtocol  = listenerProtocol("http")
+	HTTPSProtocol = listenerProtocol("https")
+	TCPProtocol   = listenerProtocol("tcp")
+	UDPProtocol   = listenerProtocol("udp")
+)
+
+type h2cMode string
+
+const (
+	H2CDisabled = h2cMode("")
+	// H2CPriorKnowledge accepts HTTP/2 from the clients that know the listener supports it
+	H2CPriorKnowledge = h2cMode("priorKnowledge")
+	// H2CUpgrade also accepts the upgrade from HTTP/1.1 requests
+	H2CUpgrade = h2cMode("upgrade")
+)
+
+var validListenerProtocols = map[listenerProtocol]bool{
+	HTTPProtocol: true, HTTPSProtocol: true, TCPProtocol: true, UDPProtocol: true,
+}
+
+const unixPrefix = "unix://"
+
+// FileListener is the listener section of the yml config file
+type FileListener struct {
+	Name     string
+	Address  string
+	Protocol string
+	// Routes is the ordered list of upstream names used when none of the hosts match
+	Routes []string
+	Hosts  []struct {
+		Names  []string
+		Routes []string
+	}
+	TLS      *FileTLS `yaml:"tls"`
+	Redirect *FileRedirect
+	HSTS     *FileHSTS `yaml:"hsts"`
+	// H2C enables HTTP/2 on the plain http listener, it is priorKnowledge (or true) or upgrade
+	// Upgrade accepts both the prior knowledge and the upgrade from HTTP/1.1 with Upgrade: h2c
+	H2C string `yaml:"h2c"`
+
+	// Upstream and timeouts (in seconds) are used by tcp and udp listeners
+	Upstream       string
+	ConnectTimeout int `yaml:"connectTimeout"`
+	IdleTimeout    int `yaml:"idleTimeout"`
+	// SendProxyProtocol is v1 or v2 PROXY header sent to the servers by tcp listeners
+	SendProxyProtocol string `yaml:"sendProxyProtocol"`
+	// MaxSessions limits the number of the client sessions of udp listeners
+	MaxSessions int `yaml:"maxSessions"`
+
+	ProxyProtocol *FileProxyProtocol `yaml:"proxyProtocol"`
+}
+
+// VirtualHost is the separate routing table selected by the request Host (or SNI)
+type VirtualHost struct {
+	Names  []string
+	Routes []string
+}
+
+type Listener struct {
+	Name string
+	// Network is the one accepted by net.Listen: tcp or unix, or by net.ListenPacket: udp
+	Network  string
+	Address  string
+	Protocol listenerProtocol
+	Routes   []string
+	Hosts    []VirtualHost
+	// TLS is set only for https listeners
+	TLS *TLS
+	// Redirect and HSTS are optional and can be set only for https listeners
+	Redirect *Redirect
+	HSTS     *HSTS
+	H2C      h2cMode
+	// Stream is set only for tcp and udp listeners
+	Stream *Stream
+	// ProxyProtocol is set when the listener accepts PROXY protocol headers
+	ProxyProtocol *ProxyProtocol
+}
+
+// parseAddress splits the listener address into the network and address suitable for net.Listen
+// Supported forms are `host:port`, `[ipv6]:port`, `:port` and `unix:///path/to/socket`
+func parseAddress(addr string) (string, string, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if path == "" {
+			return "", "", errors.Errorf("Unix socket path is missing in %s", addr)
+		}
+		return "unix", path, nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Invalid address %s", addr)
+	}
+	if port == "" {
+		return "", "", errors.Errorf("Port is missing in address %s", addr)
+	}
+	return "tcp", addr, nil
+}
+
+func isWildcardHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// samePort compares numeric ports by value, service names are compared as is
+func samePort(port1, port2 string) bool {
+	n1, err1 := strconv.Atoi(port1)
+	n2, err2 := strconv.Atoi(port2)
+	if err1 == nil && err2 == nil {
+		return n1 == n2
+	}
+	return port1 == port2
+}
+
+// sameHost compares literal IPs by value, host names are compared as is without resolving
+func sameHost(host1, host2 string) bool {
+	ip1, ip2 := net.ParseIP(host1), net.ParseIP(host2)
+	if ip1 != nil && ip2 != nil {
+		return ip1.Equal(ip2)
+	}
+	return strings.EqualFold(host1, host2)
+}
+
+// addressesConflict reports whether both addresses can not be bound at the same time
+// The wildcard host conflicts with any host on the same port, names are not resolved
+func addressesConflict(network1, address1, network2, address2 string) bool {
+	if network1 != network2 {
+		return false
+	}
+	if network1 == "unix" {
+		return filepath.Clean(address1) == filepath.Clean(address2)
+	}
+	host1, port1, err1 := net.SplitHostPort(address1)
+	host2, port2, err2 := net.SplitHostPort(address2)
+	if err1 != nil || err2 != nil {
+		return address1 == address2
+	}
+	if !samePort(port1, port2) {
+		return false
+	}
+	return isWildcardHost(host1) || isWildcardHost(host2) || sameHost(host1, host2)
+}
+
+// boundAddress is the address bound by the listener or its redirect
+type boundAddress struct {
+	listener string
+	network  string
+	address  string
+}
+
+// findConflict returns the listener that already uses the conflicting address
+func findConflict(bound []boundAddress, network, address string) (string, bool) {
+	for _, b := range bound {
+		if addressesConflict(b.network, b.address, network, address) {
+			return b.listener, true
+		}
+	}
+	return "", false
+}
+
+func validateHostName(name string) error {
+	if name == "" {
+		return errors.New("Host name can not be empty")
+	}
+	// Only leading wildcard is supported: *.example.com
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return errors.Errorf("Invalid host name %s, only leading wildcard is allowed", name)
+	}
+	return nil
+}
+
+func validateRoutes(lname string, routes []string, upstreams map[string]Upstr) error {
+	for _, r := range routes {
+		u, ok := upstreams[r]
+		if !ok {
+			return errors.Errorf("Listener %s refers to the unknown upstream %s", lname, r)
+		}
+		if u.Condition.Type == "" {
+			return errors.Errorf("Listener %s route %s should have condition", lname, r)
+		}
+	}
+	return nil
+}
+
+func (fc FileConfig) validateListeners(upstreams []Upstr) ([]Listener, error) {
+	known := make(map[string]Upstr, len(upstreams))
+	allRoutes := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		if _, ok := known[u.Name]; ok {
+			return nil, errors.Errorf("Upstream %s is declared more than once", u.Name)
+		}
+		known[u.Name] = u
+		// Only upstreams with conditions can serve as HTTP routes
+		if u.Condition.Type != "" {
+			allRoutes = append(allRoutes, u.Name)
+		}
+	}
+
+	if len(fc.Listeners) == 0 {
+		if len(allRoutes) != len(upstreams) {
+			return nil, errors.New("All upstreams should have conditions when listeners are not configured")
+		}
+		return []Listener{{
+			Name:     "default",
+			Network:  "tcp",
+			Address:  fmt.Sprintf(":%d", fc.Port),
+			Protocol: HTTPProtocol,
+			Routes:   allRoutes,
+		}}, nil
+	}
+
+	var listeners []Listener
+	names := make(map[string]bool)
+	var bound []boundAddress
+	for idx, fl := range fc.Listeners {
+		l := Listener{Name: fl.Name}
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("listener%d", idx)
+		}
+		if names[l.Name] {
+			return nil, errors.Errorf("Listener %s is declared more than once", l.Name)
+		}
+		names[l.Name] = true
+
+		network, address, err := parseAddress(fl.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Listener %s has invalid address", l.Name)
+		}
+		if strings.EqualFold(fl.Protocol, string(UDPProtocol)) {
+			if network != "tcp" {
+				return nil, errors.Errorf("Listener %s of udp protocol should have host:port address", l.Name)
+			}
+			network = "udp"
+		}
+		if other, ok := findConflict(bound, network, address); ok {
+			return nil, errors.Errorf("Listener %s address %s is already used by listener %s", l.Name, fl.Address, other)
+		}
+		bound = append(bound, boundAddress{listener: l.Name, network: network, address: address})
+		l.Network, l.Address = network, address
+
+		l.Protocol = HTTPProtocol
+		if fl.Protocol != "" {
+			l.Protocol = listenerProtocol(strings.ToLower(fl.Protocol))
+		}
+		if !validListenerProtocols[l.Protocol] {
+			return nil, errors.Errorf("Listener %s has invalid protocol %s", l.Name, fl.Protocol)
+		}
+
+		if fl.ProxyProtocol != nil {
+			if l.Protocol == UDPProtocol {
+				return nil, errors.Errorf("Listener %s of udp protocol does not support proxyProtocol", l.Name)
+			}
+			pp, err := fl.ProxyProtocol.validate()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Listener %s has invalid proxyProtocol section", l.Name)
+			}
+			l.ProxyProtocol = pp
+		}
+
+		if l.Protocol == TCPProtocol || l.Protocol == UDPProtocol {
+			st, err := fl.validateStream(l.Name, l.Protocol, known)
+			if err != nil {
+				return nil, err
+			}
+			l.Stream = st
+			listeners = append(listeners, l)
+			continue
+		}
+		if fl.Upstream != "" || fl.ConnectTimeout != 0 || fl.IdleTimeout != 0 || fl.SendProxyProtocol != "" || fl.MaxSessions != 0 {
+			return nil, errors.Errorf("Listener %s upstream, timeouts, sendProxyProtocol and maxSessions can be set only for tcp and udp protocols", l.Name)
+		}
+
+		switch {
+		case l.Protocol == HTTPSProtocol && fl.TLS == nil:
+			return nil, errors.Errorf("Listener %s is missing the tls section", l.Name)
+		case l.Protocol != HTTPSProtocol && fl.TLS != nil:
+			return nil, errors.Errorf("Listener %s has tls section, but its protocol is %s", l.Name, l.Protocol)
+		case fl.TLS != nil:
+			t, err := fl.TLS.validate()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Listener %s has invalid tls section", l.Name)
+			}
+			l.TLS = t
+		}
+
+		if l.Protocol != HTTPSProtocol && (fl.Redirect != nil || fl.HSTS != nil) {
+			return nil, errors.Errorf("Listener %s redirect and hsts sections require https protocol", l.Name)
+		}
+		if fl.Redirect != nil {
+			r, err := fl.Redirect.validate()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Listener %s has invalid redirect section", l.Name)
+			}
+			if other, ok := findConflict(bound, "tcp", r.Address); ok {
+				return nil, errors.Errorf("Listener %s redirect address %s is already used by listener %s", l.Name, r.Address, other)
+			}
+			bound = append(bound, boundAddress{listener: l.Name, network: "tcp", address: r.Address})
+			l.Redirect = r
+		}
+		if fl.HSTS != nil {
+			h, err := fl.HSTS.validate()
+			if err != nil {
+				return nil, errors.Wrapf(err, "Listener %s has invalid hsts section", l.Name)
+			}
+			l.HSTS = h
+		}
+
+		h2c, err := validateH2C(l.Name, fl.H2C)
+		if err != nil {
+			return nil, err
+		}
+		if h2c != H2CDisabled && l.Protocol != HTTPProtocol {
+			return nil, errors.Errorf("Listener %s h2c can be enabled only for http protocol", l.Name)
+		}
+		l.H2C = h2c
+
+		if err := validateRoutes(l.Name, fl.Routes, known); err != nil {
+			return nil, err
+		}
+		l.Routes = fl.Routes
+
+		hostNames := make(map[string]bool)
+		for _, fh := range fl.Hosts {
+			if len(fh.Names) == 0 {
+				return nil, errors.Errorf("Listener %s has a host without names", l.Name)
+			}
+			if len(fh.Routes) == 0 {
+				return nil, errors.Errorf("Listener %s host %s has no routes", l.Name, fh.Names[0])
+			}
+			vh := VirtualHost{Routes: fh.Routes}
+			for _, n := range fh.Names {
+				n = strings.ToLower(n)
+				if err := validateHostName(n); err != nil {
+					return nil, errors.Wrapf(err, "Listener %s", l.Name)
+				}
+				if hostNames[n] {
+					return nil, errors.Errorf("Listener %s host %s is declared more than once", l.Name, n)
+				}
+				hostNames[n] = true
+				vh.Names = append(vh.Names, n)
+			}
+			if err := validateRoutes(l.Name, fh.Routes, known); err != nil {
+				return nil, err
+			}
+			l.Hosts = append(l.Hosts, vh)
+		}
+
+		// Listener without any routing setup serves all the upstreams
+		if len(l.Routes) == 0 && len(l.Hosts) == 0 {
+			if len(allRoutes) == 0 {
+				return nil, errors.Errorf("Listener %s has no upstreams to route to", l.Name)
+			}
+			l.Routes = allRoutes
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// validateH2C returns the HTTP/2 mode of the plain http listener
+func validateH2C(lname, mode string) (h2cMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "false":
+		return H2CDisabled, nil
+	case "true", "priorknowledge":
+		return H2CPriorKnowledge, nil
+	case "upgrade":
+		return H2CUpgrade, nil
+	}
+	return H2CDisabled, errors.Errorf("Listener %s has invalid h2c value %s, expected priorKnowledge, upgrade or false", lname, mode)
+}
+
+// CheckListenerChanges returns the error when the reloaded config changes the running listeners
+// Listeners are bound on start, only their routes and hosts are applied on reload
+func CheckListenerChanges(running, next []Listener) error {
+	byName := make(map[string]Listener, len(running))
+	for _, l := range running {
+		byName[l.Name] = l
+	}
+	for _, n := range next {
+		r, ok := byName[n.Name]
+		if !ok {
+			return errors.Errorf("Listener %s is not running, listeners can not be added or renamed on reload", n.Name)
+		}
+		delete(byName, n.Name)
+		r.Routes, r.Hosts = n.Routes, n.Hosts
+		if !reflect.DeepEqual(r, n) {
+			return errors.Errorf("Listener %s can change only routes and hosts on reload, restart to apply the other settings", n.Name)
+		}
+	}
+	for name := range byName {
+		return errors.Errorf("Listener %s can not be removed on reload", name)
+	}
+	return nil
+}
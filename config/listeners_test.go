@@ -0,0 +1,120 @@
+package config
+
+import "testing"
+
+func TestValidateH2C(t *testing.T) {
+	tests := []struct {
+		mode string
+		want h2cMode
+		err  bool
+	}{
+		{mode: "", want: H2CDisabled},
+		{mode: "false", want: H2CDisabled},
+		{mode: "true", want: H2CPriorKnowledge},
+		{mode: "priorKnowledge", want: H2CPriorKnowledge},
+		{mode: "upgrade", want: H2CUpgrade},
+		{mode: "always", err: true},
+	}
+	for _, tt := range tests {
+		got, err := validateH2C("web", tt.mode)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("validateH2C(%q): expected %v with error %v, got %v %v", tt.mode, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+func TestAddressesConflict(t *testing.T) {
+	tests := []struct {
+		name               string
+		network1, address1 string
+		network2, address2 string
+		conflict           bool
+	}{
+		{name: "same address", network1: "tcp", address1: "127.0.0.1:8080", network2: "tcp", address2: "127.0.0.1:8080", conflict: true},
+		{name: "empty host and ipv4 wildcard", network1: "tcp", address1: ":8080", network2: "tcp", address2: "0.0.0.0:8080", conflict: true},
+		{name: "wildcard and specific host", network1: "tcp", address1: ":8080", network2: "tcp", address2: "127.0.0.1:8080", conflict: true},
+		{name: "ipv6 wildcard and specific host", network1: "tcp", address1: "[::]:8080", network2: "tcp", address2: "10.0.0.1:8080", conflict: true},
+		{name: "different hosts", network1: "tcp", address1: "127.0.0.1:8080", network2: "tcp", address2: "127.0.0.2:8080"},
+		{name: "different ports", network1: "tcp", address1: ":8080", network2: "tcp", address2: ":8081"},
+		{name: "service name is not resolved", network1: "tcp", address1: ":http", network2: "tcp", address2: ":80"},
+		{name: "same service name", network1: "tcp", address1: ":http", network2: "tcp", address2: ":http", conflict: true},
+		{name: "numeric ports", network1: "tcp", address1: ":080", network2: "tcp", address2: ":80", conflict: true},
+		{name: "tcp and udp", network1: "tcp", address1: ":53", network2: "udp", address2: ":53"},
+		{name: "host name is not resolved", network1: "tcp", address1: "localhost:8080", network2: "tcp", address2: "127.0.0.1:8080"},
+		{name: "same host name", network1: "tcp", address1: "LocalHost:8080", network2: "tcp", address2: "localhost:8080", conflict: true},
+		{name: "ipv4 mapped address", network1: "tcp", address1: "[::ffff:127.0.0.1]:8080", network2: "tcp", address2: "127.0.0.1:8080", conflict: true},
+		{name: "same socket", network1: "unix", address1: "/run/lb.sock", network2: "unix", address2: "/run/../run/lb.sock", conflict: true},
+		{name: "different sockets", network1: "unix", address1: "/run/lb.sock", network2: "unix", address2: "/run/admin.sock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addressesConflict(tt.network1, tt.address1, tt.network2, tt.address2); got != tt.conflict {
+				t.Errorf("expected conflict %v, got %v", tt.conflict, got)
+			}
+		})
+	}
+}
+
+func TestCheckListenerChanges(t *testing.T) {
+	running := []Listener{
+		{Name: "web", Network: "tcp", Address: ":8080", Protocol: HTTPProtocol, Routes: []string{"api"}},
+		{Name: "db", Network: "tcp", Address: ":5432", Protocol: TCPProtocol, Stream: &Stream{Upstream: "db"}},
+	}
+	changed := func(change func(ls []Listener)) []Listener {
+		ls := make([]Listener, len(running))
+		copy(ls, running)
+		change(ls)
+		return ls
+	}
+
+	tests := []struct {
+		name string
+		next []Listener
+		err  bool
+	}{
+		{name: "same listeners", next: changed(func(ls []Listener) {})},
+		{name: "routes and hosts", next: changed(func(ls []Listener) {
+			ls[0].Routes = []string{"api", "web"}
+			ls[0].Hosts = []VirtualHost{{Names: []string{"example.com"}, Routes: []string{"web"}}}
+		})},
+		{name: "renamed listener", next: changed(func(ls []Listener) { ls[0].Name = "public" }), err: true},
+		{name: "changed address", next: changed(func(ls []Listener) { ls[0].Address = ":9090" }), err: true},
+		{name: "changed stream", next: changed(func(ls []Listener) { ls[1].Stream = &Stream{Upstream: "replica"} }), err: true},
+		{name: "removed listener", next: running[:1], err: true},
+		{name: "added listener", next: append(changed(func(ls []Listener) {}), Listener{Name: "admin"}), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckListenerChanges(running, tt.next)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateListenersAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		err       bool
+	}{
+		{name: "different ports", addresses: []string{":8080", ":8081"}},
+		{name: "wildcard and loopback", addresses: []string{":8080", "127.0.0.1:8080"}, err: true},
+		{name: "wildcard forms", addresses: []string{":8080", "0.0.0.0:8080"}, err: true},
+		{name: "different hosts", addresses: []string{"127.0.0.1:8080", "127.0.0.2:8080"}},
+	}
+	upstreams := []Upstr{{Name: "api", Condition: Cond{Type: "prefix", Value: "/"}}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fc FileConfig
+			for _, a := range tt.addresses {
+				fc.Listeners = append(fc.Listeners, FileListener{Address: a, Routes: []string{"api"}})
+			}
+			_, err := fc.validateListeners(upstreams)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
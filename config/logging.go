@@ -1,11 +1,396 @@
 package config
 
-import log "github.com/sirupsen/logrus"
-
-func SetupLogging(config *Config) {
-	// TODO: add setup
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
-	// TODO: set level
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type logOutput string
+
+const (
+	StderrOutput = logOutput("stderr")
+	StdoutOutput = logOutput("stdout")
+	FileOutput   = logOutput("file")
+	SyslogOutput = logOutput("syslog")
+)
+
+// FileRotation is the rotation section of the file log output
+type FileRotation struct {
+	// MaxSize is the size of the file in megabytes that triggers the rotation
+	MaxSize int `yaml:"maxSize"`
+	// Interval is the number of seconds after which the file is rotated
+	Interval int
+	// MaxBackups is the number of rotated files to keep
+	MaxBackups int `yaml:"maxBackups"`
+	// MaxAge is the number of seconds the rotated files are kept
+	MaxAge int `yaml:"maxAge"`
+}
+
+// FileSyslog is the syslog section of the log output, local syslog is used by default
+type FileSyslog struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+// FileLogOutput describes where the log lines are written
+type FileLogOutput struct {
+	// Output is one of stderr, stdout, file or syslog
+	Output   string
+	File     string
+	Rotation *FileRotation
+	Syslog   *FileSyslog
+}
+
+// FileLogging is the logging section of the yml config file
+type FileLogging struct {
+	Level string
+	// Format is text or json
+	Format        string
+	FileLogOutput `yaml:",inline"`
+}
+
+type Rotation struct {
+	MaxSize    int64
+	Interval   time.Duration
+	MaxBackups int
+	MaxAge     time.Duration
+}
+
+type Syslog struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+type LogOutput struct {
+	Output logOutput
+	File   string
+	// Rotation is nil when the file is never rotated
+	Rotation *Rotation
+	Syslog   *Syslog
+}
+
+type Logging struct {
+	Level  log.Level
+	JSON   bool
+	Output LogOutput
+}
+
+func (fo FileLogOutput) validate(name string, fallback logOutput) (*LogOutput, error) {
+	lo := &LogOutput{Output: logOutput(strings.ToLower(fo.Output))}
+	if lo.Output == "" {
+		lo.Output = fallback
+	}
+
+	switch lo.Output {
+	case StderrOutput, StdoutOutput:
+	case FileOutput:
+		if fo.File == "" {
+			return nil, errors.Errorf("%s file output requires the file field", name)
+		}
+		lo.File = fo.File
+	case SyslogOutput:
+		lo.Syslog = &Syslog{Tag: "loadbalancer"}
+		if s := fo.Syslog; s != nil {
+			if (s.Network == "") != (s.Address == "") {
+				return nil, errors.Errorf("%s syslog requires both network and address", name)
+			}
+			lo.Syslog.Network, lo.Syslog.Address = s.Network, s.Address
+			if s.Tag != "" {
+				lo.Syslog.Tag = s.Tag
+			}
+		}
+	default:
+		return nil, errors.Errorf("%s has unknown output %s", name, fo.Output)
+	}
+
+	if fo.File != "" && lo.Output != FileOutput {
+		return nil, errors.Errorf("%s file can be used only with file output", name)
+	}
+	if fo.Syslog != nil && lo.Output != SyslogOutput {
+		return nil, errors.Errorf("%s syslog section can be used only with syslog output", name)
+	}
+	if r := fo.Rotation; r != nil {
+		if lo.Output != FileOutput {
+			return nil, errors.Errorf("%s rotation can be used only with file output", name)
+		}
+		if r.MaxSize < 0 || r.Interval < 0 || r.MaxBackups < 0 || r.MaxAge < 0 {
+			return nil, errors.Errorf("%s rotation values should be positive", name)
+		}
+		if r.MaxSize == 0 && r.Interval == 0 {
+			return nil, errors.Errorf("%s rotation requires maxSize or interval", name)
+		}
+		lo.Rotation = &Rotation{
+			MaxSize:    int64(r.MaxSize) * 1024 * 1024,
+			Interval:   time.Duration(r.Interval) * time.Second,
+			MaxBackups: r.MaxBackups,
+			MaxAge:     time.Duration(r.MaxAge) * time.Second,
+		}
+	}
+	return lo, nil
+}
+
+func (fl *FileLogging) validate() (*Logging, error) {
+	if fl == nil {
+		fl = &FileLogging{}
+	}
+
+	l := &Logging{Level: log.InfoLevel}
+	if fl.Level != "" {
+		level, err := log.ParseLevel(fl.Level)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid logging level")
+		}
+		l.Level = level
+	}
+
+	switch strings.ToLower(fl.Format) {
+	case "", "text":
+	case "json":
+		l.JSON = true
+	default:
+		return nil, errors.Errorf("Unknown logging format %s", fl.Format)
+	}
+
+	output, err := fl.FileLogOutput.validate("Logging", StderrOutput)
+	if err != nil {
+		return nil, err
+	}
+	l.Output = *output
+	return l, nil
+}
+
+// openLogOutput returns the writer for the output, the writer should be closed when it is replaced
+func openLogOutput(lo LogOutput) (io.WriteCloser, error) {
+	switch lo.Output {
+	case StdoutOutput:
+		return nopCloser{os.Stdout}, nil
+	case FileOutput:
+		return openRotatingFile(lo.File, lo.Rotation)
+	case SyslogOutput:
+		w, err := syslog.Dial(lo.Syslog.Network, lo.Syslog.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, lo.Syslog.Tag)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can not connect to syslog")
+		}
+		return w, nil
+	}
+	return nopCloser{os.Stderr}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// outputs keeps the open log writers, so they are reopened on reload only when their config is changed
+var outputs = struct {
+	sync.Mutex
+	main      io.WriteCloser
+	mainCfg   LogOutput
+	access    io.WriteCloser
+	accessCfg *LogOutput
+	audit     io.WriteCloser
+	auditCfg  *LogOutput
+}{}
+
+// accessLogWriter is handed to the access logger once, its target is replaced on reload
+var accessLogWriter = &switchWriter{w: nopCloser{os.Stdout}}
+
+// AccessLogWriter returns the writer of the access log
+// It writes to the main log output unless the access log has its own one
+func AccessLogWriter() io.Writer {
+	return accessLogWriter
+}
+
+// auditLogWriter is handed to the admin API once, like the accessLogWriter
+var auditLogWriter = &switchWriter{w: nopCloser{os.Stderr}}
+
+// AuditLogWriter returns the writer of the admin audit log
+// It writes to the main log output unless the audit log has its own one
+func AuditLogWriter() io.Writer {
+	return auditLogWriter
+}
+
+// validateLogFiles checks the outputs writing to the same file agree on its rotation
+// Such outputs share the writer, otherwise both of them would rotate the file
+func validateLogFiles(config *Config) error {
+	files := map[string]LogOutput{config.Logging.Output.File: config.Logging.Output}
+	var extra []*LogOutput
+	if config.AccessLog != nil {
+		extra = append(extra, config.AccessLog.Output)
+	}
+	if config.Admin != nil {
+		extra = append(extra, config.Admin.Audit)
+	}
+	for _, lo := range extra {
+		if lo == nil || lo.Output != FileOutput {
+			continue
+		}
+		if other, ok := files[lo.File]; ok && other.Output == FileOutput && !sameOutput(other, *lo) {
+			return errors.Errorf("Log file %s is used by several outputs with different rotation settings", lo.File)
+		}
+		files[lo.File] = *lo
+	}
+	return nil
+}
+
+func sameOutput(a, b LogOutput) bool {
+	if a.Output != b.Output || a.File != b.File {
+		return false
+	}
+	if (a.Rotation == nil) != (b.Rotation == nil) || (a.Rotation != nil && *a.Rotation != *b.Rotation) {
+		return false
+	}
+	return (a.Syslog == nil) == (b.Syslog == nil) && (a.Syslog == nil || *a.Syslog == *b.Syslog)
+}
+
+type openOutput struct {
+	cfg LogOutput
+	w   io.WriteCloser
+}
+
+// outputSet opens the writers of the new config
+// Outputs with the same config share the writer, so the same file is never rotated by two writers
+type outputSet struct {
+	current []openOutput
+	chosen  []openOutput
+	opened  []io.WriteCloser
+}
+
+func (s *outputSet) get(cfg LogOutput) (io.WriteCloser, error) {
+	for _, list := range [][]openOutput{s.chosen, s.current} {
+		for _, o := range list {
+			if sameOutput(o.cfg, cfg) {
+				s.chosen = append(s.chosen, o)
+				return o.w, nil
+			}
+		}
+	}
+	w, err := openLogOutput(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.opened = append(s.opened, w)
+	s.chosen = append(s.chosen, openOutput{cfg: cfg, w: w})
+	return w, nil
+}
+
+// getOptional returns nil when the output is not configured
+func (s *outputSet) getOptional(cfg *LogOutput) (io.WriteCloser, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	return s.get(*cfg)
+}
+
+func (s *outputSet) used(w io.WriteCloser) bool {
+	for _, o := range s.chosen {
+		if o.w == w {
+			return true
+		}
+	}
+	return false
+}
+
+// fail closes the writers opened for the new config
+func (s *outputSet) fail(err error, msg string) error {
+	for _, w := range s.opened {
+		w.Close()
+	}
+	return errors.Wrap(err, msg)
+}
+
+// closeUnused closes the previous writers that are not used by the new config
+func (s *outputSet) closeUnused() {
+	var closed []io.WriteCloser
+	for _, o := range s.current {
+		if s.used(o.w) {
+			continue
+		}
+		done := false
+		for _, c := range closed {
+			done = done || c == o.w
+		}
+		if !done {
+			o.w.Close()
+			closed = append(closed, o.w)
+		}
+	}
+}
+
+// SetupLogging applies the logging config, it is called again on reload
+// Outputs that can not be opened keep the previous configuration
+func SetupLogging(config *Config) error {
+	lc := config.Logging
+	outputs.Lock()
+	defer outputs.Unlock()
+
+	set := &outputSet{}
+	if outputs.main != nil {
+		set.current = append(set.current, openOutput{cfg: outputs.mainCfg, w: outputs.main})
+	}
+	if outputs.access != nil {
+		set.current = append(set.current, openOutput{cfg: *outputs.accessCfg, w: outputs.access})
+	}
+	if outputs.audit != nil {
+		set.current = append(set.current, openOutput{cfg: *outputs.auditCfg, w: outputs.audit})
+	}
+
+	var accessCfg, auditCfg *LogOutput
+	if config.AccessLog != nil {
+		accessCfg = config.AccessLog.Output
+	}
+	if config.Admin != nil {
+		auditCfg = config.Admin.Audit
+	}
+	main, err := set.get(lc.Output)
+	if err != nil {
+		return set.fail(err, "Can not open log output")
+	}
+	access, err := set.getOptional(accessCfg)
+	if err != nil {
+		return set.fail(err, "Can not open access log output")
+	}
+	audit, err := set.getOptional(auditCfg)
+	if err != nil {
+		return set.fail(err, "Can not open audit log output")
+	}
+
+	if lc.JSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{
+			FullTimestamp: true,
+		})
+	}
+	log.SetLevel(lc.Level)
+	log.SetOutput(main)
+	if access != nil {
+		accessLogWriter.set(access)
+	} else {
+		accessLogWriter.set(nopCloser{main})
+	}
+	if audit != nil {
+		auditLogWriter.set(audit)
+	} else {
+		auditLogWriter.set(nopCloser{main})
+	}
+
+	// Previous writers are closed after nothing writes to them anymore
+	set.closeUnused()
+	outputs.main, outputs.mainCfg = main, lc.Output
+	outputs.access, outputs.accessCfg = access, accessCfg
+	outputs.audit, outputs.auditCfg = audit, auditCfg
+	return nil
 }
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// switchWriter allows to replace the target writer while it is used
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *switchWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.w.Write(b)
+}
+
+func (sw *switchWriter) set(w io.Writer) {
+	sw.mu.Lock()
+	sw.w = w
+	sw.mu.Unlock()
+}
+
+// rotatedSuffix is appended to the name of the rotated file
+const rotatedSuffix = "2006-01-02T15-04-05.000"
+
+// rotatingFile moves the log file aside when it grows too big or too old
+// Rotated files are named <file>.<time> and removed according to the retention settings
+type rotatingFile struct {
+	path     string
+	rotation *Rotation
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	closed   bool
+}
+
+func openRotatingFile(path string, rotation *Rotation) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, rotation: rotation}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return errors.Wrapf(err, "Can not create log directory for %s", rf.path)
+	}
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Can not open log file %s", rf.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Can not stat log file %s", rf.path)
+	}
+	rf.file, rf.size = f, info.Size()
+	// Interval of the existing file is counted from its last change, so restarts do not postpone the rotation
+	rf.openedAt = time.Now()
+	if rf.size > 0 {
+		rf.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (rf *rotatingFile) shouldRotate(n int) bool {
+	r := rf.rotation
+	if r == nil || rf.size == 0 {
+		return false
+	}
+	if r.MaxSize > 0 && rf.size+int64(n) > r.MaxSize {
+		return true
+	}
+	return r.Interval > 0 && time.Since(rf.openedAt) >= r.Interval
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.file.Close()
+	rf.file = nil
+	rotated := rf.path + "." + time.Now().Format(rotatedSuffix)
+	renameErr := os.Rename(rf.path, rotated)
+	// The file is reopened even if it was not moved, so the logs are not lost
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return errors.Wrapf(renameErr, "Can not rotate log file %s", rf.path)
+	}
+	rf.cleanup()
+	return nil
+}
+
+// cleanup removes the rotated files beyond the retention limits
+func (rf *rotatingFile) cleanup() {
+	r := rf.rotation
+	if r.MaxBackups == 0 && r.MaxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotatedSuffix, strings.TrimPrefix(m, rf.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// Suffix sorts in time order, the newest files go first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, b := range backups {
+		expired := false
+		if r.MaxAge > 0 {
+			if info, err := os.Stat(b); err == nil && time.Since(info.ModTime()) > r.MaxAge {
+				expired = true
+			}
+		}
+		if (r.MaxBackups > 0 && i >= r.MaxBackups) || expired {
+			os.Remove(b)
+		}
+	}
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.file == nil {
+		// Previous rotation could not reopen the file
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.shouldRotate(len(b)) {
+		// Errors are not reported while the line can still be written to the current file
+		if err := rf.rotate(); err != nil && rf.file == nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.closed = true
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
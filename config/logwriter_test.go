@@ -0,0 +1,186 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logwriter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func rotatedFiles(t *testing.T, path string) []string {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := testLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "lb.log")
+
+	rf, err := openRotatingFile(path, &Rotation{MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	lines := []string{"first\n", "second\n", "third\n", "fourth\n", "fifth\n"}
+	for _, line := range lines {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated files are named by the time in milliseconds
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fifth\n" {
+		t.Errorf("expected the last line in the current file, got %q", data)
+	}
+	backups := rotatedFiles(t, path)
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	// Newest backups are kept
+	for _, b := range backups {
+		data, err := ioutil.ReadFile(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(data); s != "third\n" && s != "fourth\n" {
+			t.Errorf("unexpected backup %s with %q", b, s)
+		}
+	}
+}
+
+func TestRotatingFileWithoutRotation(t *testing.T) {
+	dir := testLogDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.log")
+
+	rf, err := openRotatingFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte(strings.Repeat("x", 100)))
+	rf.Close()
+	if _, err := rf.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("expected write to the closed file to fail, got %v", err)
+	}
+	if backups := rotatedFiles(t, path); len(backups) != 0 {
+		t.Errorf("expected no backups, got %v", backups)
+	}
+}
+
+func TestOutputSet(t *testing.T) {
+	dir := testLogDir(t)
+	defer os.RemoveAll(dir)
+	file := func(name string, maxSize int64) LogOutput {
+		return LogOutput{Output: FileOutput, File: filepath.Join(dir, name), Rotation: &Rotation{MaxSize: maxSize}}
+	}
+
+	set := &outputSet{}
+	main, err := set.get(file("lb.log", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := set.get(file("lb.log", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main != access {
+		t.Errorf("outputs with the same file should share the writer")
+	}
+	audit, err := set.get(file("audit.log", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit == main || len(set.opened) != 2 {
+		t.Errorf("expected 2 writers, got %d", len(set.opened))
+	}
+
+	// Reload keeps the unchanged writer and closes the one that is not used anymore
+	reload := &outputSet{current: set.chosen}
+	main2, err := reload.get(file("lb.log", 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if main2 != main || len(reload.opened) != 0 {
+		t.Errorf("unchanged output should keep its writer")
+	}
+	reload.closeUnused()
+	if _, err := audit.Write([]byte("x")); err != os.ErrClosed {
+		t.Errorf("unused writer should be closed, got %v", err)
+	}
+	if _, err := main.Write([]byte("x")); err != nil {
+		t.Errorf("used writer should stay open, got %v", err)
+	}
+	main.Close()
+}
+
+func TestValidateLogFiles(t *testing.T) {
+	output := func(file string, maxSize int64) *LogOutput {
+		return &LogOutput{Output: FileOutput, File: file, Rotation: &Rotation{MaxSize: maxSize}}
+	}
+	tests := []struct {
+		name   string
+		config Config
+		err    bool
+	}{
+		{
+			name: "same file with the same rotation",
+			config: Config{
+				Logging:   &Logging{Output: *output("lb.log", 100)},
+				AccessLog: &AccessLog{Output: output("lb.log", 100)},
+			},
+		},
+		{
+			name: "different files",
+			config: Config{
+				Logging:   &Logging{Output: *output("lb.log", 100)},
+				AccessLog: &AccessLog{Output: output("access.log", 200)},
+				Admin:     &Admin{Audit: output("audit.log", 300)},
+			},
+		},
+		{
+			name: "access log with different rotation",
+			config: Config{
+				Logging:   &Logging{Output: *output("lb.log", 100)},
+				AccessLog: &AccessLog{Output: output("lb.log", 200)},
+			},
+			err: true,
+		},
+		{
+			name: "audit log with different rotation",
+			config: Config{
+				Logging:   &Logging{Output: LogOutput{Output: StderrOutput}},
+				AccessLog: &AccessLog{Output: output("access.log", 100)},
+				Admin:     &Admin{Audit: output("access.log", 0)},
+			},
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLogFiles(&tt.config)
+			if (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
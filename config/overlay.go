@@ -0,0 +1,106 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type serverState string
+
+const (
+	// ActiveState servers receive the new requests
+	ActiveState = serverState("active")
+	// DrainingState servers finish the requests in flight and receive no new ones
+	DrainingState = serverState("draining")
+	// DisabledState servers are taken out of the rotation
+	DisabledState = serverState("disabled")
+)
+
+// GetServerState validates the state set with the admin API
+func GetServerState(s string) (serverState, error) {
+	switch st := serverState(s); st {
+	case ActiveState, DrainingState, DisabledState:
+		return st, nil
+	}
+	return "", errors.Errorf("Unknown server state %s, should be active, draining or disabled", s)
+}
+
+// ServerOverride is the state and weight of the server changed at runtime
+type ServerOverride struct {
+	State  serverState `yaml:"state,omitempty"`
+	Weight int         `yaml:"weight,omitempty"`
+}
+
+// UpstreamOverlay holds the runtime changes of the upstream servers
+// Servers are identified by their normalized URL, e.g. http://127.0.0.1:8080
+type UpstreamOverlay struct {
+	Added     []FileServer              `yaml:"added,omitempty"`
+	Removed   []string                  `yaml:"removed,omitempty"`
+	Overrides map[string]ServerOverride `yaml:"overrides,omitempty"`
+}
+
+// Overlay is the set of the server changes made with the admin API
+// It is applied on top of the config file, so the changes survive the reloads
+type Overlay struct {
+	Upstreams map[string]*UpstreamOverlay `yaml:"upstreams"`
+}
+
+// Upstream returns the overlay of the upstream, it is created when missing
+func (o *Overlay) Upstream(name string) *UpstreamOverlay {
+	if o.Upstreams == nil {
+		o.Upstreams = make(map[string]*UpstreamOverlay)
+	}
+	uo, ok := o.Upstreams[name]
+	if !ok {
+		uo = &UpstreamOverlay{Overrides: make(map[string]ServerOverride)}
+		o.Upstreams[name] = uo
+	}
+	if uo.Overrides == nil {
+		uo.Overrides = make(map[string]ServerOverride)
+	}
+	return uo
+}
+
+// ReadOverlay reads the overlay file, missing file is the empty overlay
+func ReadOverlay(path string) (*Overlay, error) {
+	o := &Overlay{}
+	if path == "" {
+		return o, nil
+	}
+	source, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can not read overlay %s", path)
+	}
+	if err := yaml.Unmarshal(source, o); err != nil {
+		return nil, errors.Wrapf(err, "Can not parse overlay %s", path)
+	}
+	return o, nil
+}
+
+// WriteOverlay replaces the overlay file, so it is never left partially written
+func WriteOverlay(path string, o *Overlay) error {
+	data, err := yaml.Marshal(o)
+	if err != nil {
+		return errors.Wrap(err, "Can not encode overlay")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "Can not write overlay %s", path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Can not write overlay %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Can not write overlay %s", path)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "Can not write overlay %s", path)
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileProxyProtocol is the proxyProtocol section of the listener in the yml config file
+type FileProxyProtocol struct {
+	TrustedCIDRs []string `yaml:"trustedCIDRs"`
+	// Required rejects the trusted connections without the header, otherwise the header is optional
+	// Optional header delays the server-first protocols, their clients are served only after the header timeout
+	Required bool
+	// Timeout is the time in seconds the trusted client has to send the header, 5 by default
+	Timeout int
+}
+
+// ProxyProtocol describes which connections are allowed to carry the PROXY protocol header
+type ProxyProtocol struct {
+	Trusted  []*net.IPNet
+	Required bool
+	Timeout  time.Duration
+}
+
+// splitList splits the comma separated config value
+func splitList(value string) []string {
+	var items []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			items = append(items, v)
+		}
+	}
+	return items
+}
+
+// parseCIDRs accepts both CIDRs and single IP addresses
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.Errorf("Invalid IP address %s", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid CIDR %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (fp *FileProxyProtocol) validate() (*ProxyProtocol, error) {
+	if len(fp.TrustedCIDRs) == 0 {
+		return nil, errors.New("At least one trusted CIDR is required")
+	}
+	trusted, err := parseCIDRs(fp.TrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if fp.Timeout < 0 {
+		return nil, errors.New("Timeout should be positive")
+	}
+	pp := ProxyProtocol{Trusted: trusted, Required: fp.Required, Timeout: time.Duration(fp.Timeout) * time.Second}
+	if pp.Timeout == 0 {
+		pp.Timeout = 5 * time.Second
+	}
+	return &pp, nil
+}
+
+// parseProxyProtocolVersion converts v1/v2 into the protocol version, empty value means header is not sent
+func parseProxyProtocolVersion(v string) (int, error) {
+	switch strings.ToLower(v) {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return 1, nil
+	case "v2", "2":
+		return 2, nil
+	}
+	return 0, errors.Errorf("Unknown PROXY protocol version %s", v)
+}
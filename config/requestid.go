@@ -0,0 +1,119 @@
+package config
+
+import (
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type requestIDTrust string
+
+const (
+	// TrustAlways accepts the request ID from any client
+	TrustAlways = requestIDTrust("always")
+	// TrustNever always generates the new request ID
+	TrustNever = requestIDTrust("never")
+	// TrustProxies accepts the request ID only from the trustedProxies
+	TrustProxies = requestIDTrust("proxies")
+)
+
+// FileRequestID is the requestId section of the yml config file
+type FileRequestID struct {
+	// Header is X-Request-Id by default
+	Header string
+	// Trust is always, never or proxies
+	Trust     string
+	MaxLength int `yaml:"maxLength"`
+	// Echo returns the request ID in the response headers, enabled by default
+	Echo *bool
+}
+
+type RequestID struct {
+	Header    string
+	Trust     requestIDTrust
+	MaxLength int
+	Echo      bool
+}
+
+// DefaultRequestID keeps the behavior of the configs without the requestId section
+var DefaultRequestID = RequestID{Header: "X-Request-Id", Trust: TrustAlways, MaxLength: 128, Echo: true}
+
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidRequestID reports whether the incoming request ID can be used in logs and headers as is
+func (rc RequestID) ValidRequestID(id string) bool {
+	if id == "" || len(id) > rc.MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("-_.:+/=@", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hop-by-hop and framing headers would be removed or replaced on the way to the upstream
+var reservedRequestIDHeaders = map[string]struct{}{
+	"Host":                {},
+	"Connection":          {},
+	"Proxy-Connection":    {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+	"Content-Length":      {},
+}
+
+func (fr *FileRequestID) validate() (*RequestID, error) {
+	rc := DefaultRequestID
+	if fr == nil {
+		return &rc, nil
+	}
+
+	if fr.Header != "" {
+		if !isHeaderName(fr.Header) {
+			return nil, errors.Errorf("Invalid requestId header %q", fr.Header)
+		}
+		rc.Header = textproto.CanonicalMIMEHeaderKey(fr.Header)
+		if _, ok := reservedRequestIDHeaders[rc.Header]; ok {
+			return nil, errors.Errorf("Header %s can not be used for the request ID", rc.Header)
+		}
+	}
+
+	trust := requestIDTrust(strings.ToLower(fr.Trust))
+	switch trust {
+	case "":
+	case TrustAlways, TrustNever, TrustProxies:
+		rc.Trust = trust
+	default:
+		return nil, errors.Errorf("Unknown requestId trust %s, should be always, never or proxies", fr.Trust)
+	}
+
+	if fr.MaxLength < 0 {
+		return nil, errors.New("requestId maxLength should be positive")
+	}
+	if fr.MaxLength != 0 {
+		rc.MaxLength = fr.MaxLength
+	}
+	if fr.Echo != nil {
+		rc.Echo = *fr.Echo
+	}
+	return &rc, nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestValidateRequestIDHeader(t *testing.T) {
+	tests := []struct {
+		header  string
+		wantErr bool
+	}{
+		{header: "X-Request-Id"},
+		{header: "x-correlation-id"},
+		{header: "host", wantErr: true},
+		{header: "Connection", wantErr: true},
+		{header: "te", wantErr: true},
+		{header: "Upgrade", wantErr: true},
+		{header: "keep-alive", wantErr: true},
+		{header: "Transfer-Encoding", wantErr: true},
+		{header: "Proxy-Connection", wantErr: true},
+		{header: "Trailer", wantErr: true},
+		{header: "content-length", wantErr: true},
+		{header: "bad header", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			_, err := (&FileRequestID{Header: tt.header}).validate()
+			if tt.wantErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
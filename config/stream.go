@@ -0,0 +1,81 @@
+package config
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Stream describes the listener that forwards the raw connections or datagrams to the single upstream
+type Stream struct {
+	Upstream string
+	// ConnectTimeout is used only by tcp listeners
+	ConnectTimeout time.Duration
+	// IdleTimeout closes the connection when no data is transferred in any direction, zero disables it
+	// For udp listeners it is the time the idle client session is kept
+	IdleTimeout time.Duration
+	// SendProxyProtocol is the version of PROXY header sent to the server, 0 disables it
+	SendProxyProtocol int
+	// MaxSessions is used only by udp listeners, datagrams of the new clients are dropped above it
+	MaxSessions int
+}
+
+// DefaultMaxSessions limits the udp sessions when maxSessions is not set
+// Every session holds the socket, so the clients can not exhaust the file descriptors
+const DefaultMaxSessions = 10000
+
+func (fl FileListener) validateStream(lname string, protocol listenerProtocol, upstreams map[string]Upstr) (*Stream, error) {
+	if len(fl.Routes) != 0 || len(fl.Hosts) != 0 || fl.TLS != nil || fl.Redirect != nil || fl.HSTS != nil || fl.H2C != "" {
+		return nil, errors.Errorf("Listener %s of %s protocol supports only upstream and timeouts", lname, fl.Protocol)
+	}
+	if fl.Upstream == "" {
+		return nil, errors.Errorf("Listener %s is missing the upstream field", lname)
+	}
+	u, ok := upstreams[fl.Upstream]
+	if !ok {
+		return nil, errors.Errorf("Listener %s refers to the unknown upstream %s", lname, fl.Upstream)
+	}
+	if fl.ConnectTimeout < 0 || fl.IdleTimeout < 0 {
+		return nil, errors.Errorf("Listener %s timeouts should be positive", lname)
+	}
+	if fl.MaxSessions < 0 {
+		return nil, errors.Errorf("Listener %s maxSessions should be positive", lname)
+	}
+
+	st := Stream{
+		Upstream:       fl.Upstream,
+		ConnectTimeout: time.Duration(fl.ConnectTimeout) * time.Second,
+		IdleTimeout:    time.Duration(fl.IdleTimeout) * time.Second,
+	}
+	version, err := parseProxyProtocolVersion(fl.SendProxyProtocol)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Listener %s has invalid sendProxyProtocol", lname)
+	}
+	st.SendProxyProtocol = version
+
+	if protocol == UDPProtocol {
+		if fl.ConnectTimeout != 0 || fl.SendProxyProtocol != "" {
+			return nil, errors.Errorf("Listener %s of udp protocol does not support connectTimeout and sendProxyProtocol", lname)
+		}
+		st.MaxSessions = fl.MaxSessions
+		if st.MaxSessions == 0 {
+			st.MaxSessions = DefaultMaxSessions
+		}
+		if hasUnixServer(u.Servers) {
+			return nil, errors.Errorf("Listener %s of udp protocol can not use unix socket servers of upstream %s", lname, u.Name)
+		}
+		// Sessions should expire, otherwise every client would hold the socket forever
+		if st.IdleTimeout == 0 {
+			st.IdleTimeout = 30 * time.Second
+		}
+		return &st, nil
+	}
+
+	if fl.MaxSessions != 0 {
+		return nil, errors.Errorf("Listener %s of tcp protocol does not support maxSessions", lname)
+	}
+	if st.ConnectTimeout == 0 {
+		st.ConnectTimeout = 5 * time.Second
+	}
+	return &st, nil
+}
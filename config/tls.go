@@ -0,0 +1,232 @@
+package config
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FileTLS is the tls section of the listener in the yml config file
+type FileTLS struct {
+	Certificates []struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+	}
+	MinVersion   string   `yaml:"minVersion"`
+	CipherSuites []string `yaml:"cipherSuites"`
+	ALPN         []string `yaml:"alpn"`
+	// ClientAuth is one of none, optional or require
+	ClientAuth string `yaml:"clientAuth"`
+	ClientCA   string `yaml:"clientCA"`
+}
+
+type CertPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLS struct {
+	Certificates []CertPair
+	MinVersion   uint16
+	// CipherSuites is empty when Go defaults should be used
+	CipherSuites []uint16
+	ALPN         []string
+	ClientAuth   tls.ClientAuthType
+	// ClientCA is the path to the PEM bundle used to verify client certificates
+	ClientCA string
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts version in form of `1.2` or `TLS1.2` into the crypto/tls constant
+func ParseTLSVersion(v string) (uint16, error) {
+	if v == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(v), "TLS")]
+	if !ok {
+		return 0, errors.Errorf("Unknown TLS version %s", v)
+	}
+	return version, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, n := range names {
+		id, ok := known[strings.ToUpper(n)]
+		if !ok {
+			return nil, errors.Errorf("Unknown cipher suite %s", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (ft *FileTLS) validate() (*TLS, error) {
+	if len(ft.Certificates) == 0 {
+		return nil, errors.New("At least one certificate is required")
+	}
+
+	t := TLS{ALPN: ft.ALPN}
+	for _, c := range ft.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("Certificate should have both certFile and keyFile")
+		}
+		t.Certificates = append(t.Certificates, CertPair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+
+	version, err := ParseTLSVersion(ft.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	t.MinVersion = version
+
+	suites, err := parseCipherSuites(ft.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	t.CipherSuites = suites
+
+	if len(t.ALPN) == 0 {
+		t.ALPN = []string{"h2", "http/1.1"}
+	}
+
+	auth, ok := clientAuthTypes[strings.ToLower(ft.ClientAuth)]
+	if !ok {
+		return nil, errors.Errorf("Unknown clientAuth %s", ft.ClientAuth)
+	}
+	if auth != tls.NoClientCert && ft.ClientCA == "" {
+		return nil, errors.New("clientCA is required to verify client certificates")
+	}
+	t.ClientAuth = auth
+	t.ClientCA = ft.ClientCA
+	return &t, nil
+}
+
+// FileRedirect is the plain HTTP companion listener of the https listener in the yml config file
+type FileRedirect struct {
+	Address    string
+	Status     int
+	Exceptions []string
+}
+
+// FileHSTS is the Strict-Transport-Security setup of the https listener in the yml config file
+type FileHSTS struct {
+	MaxAge            int  `yaml:"maxAge"`
+	IncludeSubDomains bool `yaml:"includeSubDomains"`
+	Preload           bool
+}
+
+// Redirect describes the plain HTTP listener that sends the clients to the https listener
+type Redirect struct {
+	Address string
+	// Status is either 301 or 308
+	Status int
+	// Exceptions are the paths that are served by the https listener routes instead of redirect
+	// Path with trailing slash matches all the nested paths
+	Exceptions []string
+}
+
+type HSTS struct {
+	MaxAge            int
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+func (fr *FileRedirect) validate() (*Redirect, error) {
+	network, address, err := parseAddress(fr.Address)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return nil, errors.Errorf("Redirect address should be tcp address, got %s", fr.Address)
+	}
+
+	r := Redirect{Address: address, Status: fr.Status, Exceptions: fr.Exceptions}
+	if r.Status == 0 {
+		r.Status = http.StatusMovedPermanently
+	}
+	if r.Status != http.StatusMovedPermanently && r.Status != http.StatusPermanentRedirect {
+		return nil, errors.Errorf("Redirect status should be 301 or 308, got %d", fr.Status)
+	}
+	for _, e := range r.Exceptions {
+		if !strings.HasPrefix(e, "/") {
+			return nil, errors.Errorf("Redirect exception %s should start with /", e)
+		}
+	}
+	return &r, nil
+}
+
+func (fh *FileHSTS) validate() (*HSTS, error) {
+	if fh.MaxAge <= 0 {
+		return nil, errors.Errorf("HSTS maxAge should be positive, got %d", fh.MaxAge)
+	}
+	// See https://hstspreload.org/#submission-requirements
+	if fh.Preload && (!fh.IncludeSubDomains || fh.MaxAge < 31536000) {
+		return nil, errors.New("HSTS preload requires includeSubDomains and maxAge of at least one year")
+	}
+	return &HSTS{MaxAge: fh.MaxAge, IncludeSubDomains: fh.IncludeSubDomains, Preload: fh.Preload}, nil
+}
+
+// FileUpstreamTLS is the tls section of the upstream in the yml config file
+type FileUpstreamTLS struct {
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	MinVersion         string `yaml:"minVersion"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// UpstreamTLS describes how the proxy connects to the https upstream servers
+type UpstreamTLS struct {
+	// CAFile is empty when system roots should be used
+	CAFile string
+	// Client certificate is optional and used for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and certificate verification
+	ServerName         string
+	MinVersion         uint16
+	InsecureSkipVerify bool
+}
+
+func (ft *FileUpstreamTLS) validate() (*UpstreamTLS, error) {
+	if (ft.CertFile == "") != (ft.KeyFile == "") {
+		return nil, errors.New("Client certificate should have both certFile and keyFile")
+	}
+	version, err := ParseTLSVersion(ft.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamTLS{
+		CAFile:             ft.CAFile,
+		CertFile:           ft.CertFile,
+		KeyFile:            ft.KeyFile,
+		ServerName:         ft.ServerName,
+		MinVersion:         version,
+		InsecureSkipVerify: ft.InsecureSkipVerify,
+	}, nil
+}
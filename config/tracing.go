@@ -0,0 +1,69 @@
+package config
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileTracing is the tracing section of the yml config file
+type FileTracing struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, e.g. http://127.0.0.1:4318/v1/traces
+	Endpoint    string
+	ServiceName string `yaml:"serviceName"`
+	// SampleRatio is the share of the new traces that are recorded, the sampled flag of the parent is respected
+	SampleRatio *float64 `yaml:"sampleRatio"`
+	// Headers are sent with every export request, e.g. for the collector authentication
+	Headers map[string]string
+	// FlushInterval is the number of seconds the spans are batched for
+	FlushInterval int `yaml:"flushInterval"`
+	BatchSize     int `yaml:"batchSize"`
+}
+
+type Tracing struct {
+	Endpoint      string
+	ServiceName   string
+	SampleRatio   float64
+	Headers       map[string]string
+	FlushInterval time.Duration
+	BatchSize     int
+}
+
+func (ft *FileTracing) validate() (*Tracing, error) {
+	if ft == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(ft.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("Tracing endpoint %q should be http or https URL", ft.Endpoint)
+	}
+
+	t := &Tracing{
+		Endpoint:      ft.Endpoint,
+		ServiceName:   ft.ServiceName,
+		SampleRatio:   1,
+		Headers:       ft.Headers,
+		FlushInterval: time.Duration(ft.FlushInterval) * time.Second,
+		BatchSize:     ft.BatchSize,
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = "loadbalancer"
+	}
+	if ft.SampleRatio != nil {
+		if *ft.SampleRatio < 0 || *ft.SampleRatio > 1 {
+			return nil, errors.New("Tracing sampleRatio should be between 0 and 1")
+		}
+		t.SampleRatio = *ft.SampleRatio
+	}
+	if ft.FlushInterval < 0 || ft.BatchSize < 0 {
+		return nil, errors.New("Tracing flushInterval and batchSize should be positive")
+	}
+	if t.FlushInterval == 0 {
+		t.FlushInterval = 5 * time.Second
+	}
+	if t.BatchSize == 0 {
+		t.BatchSize = 512
+	}
+	return t, nil
+}
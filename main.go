@@ -1,7 +1,15 @@
+// Command loadbalancer proxies HTTP, TCP and UDP traffic according to the yml config
+//
+// Building requires Go 1.24 or newer, http.Protocols is used for HTTP/2 over cleartext,
+// and golang.org/x/net for the h2c upgrade
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
 
 	"github.com/electroprovodka/loadbalancer/config"
 	"github.com/electroprovodka/loadbalancer/proxy"
@@ -18,23 +26,76 @@ func parseFlags() string {
 	return config
 }
 
+// headerFlags collects the repeated -H "Name: value" flags
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlags) Set(v string) error {
+	parts := strings.SplitN(v, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header should be in the Name: value form, got %q", v)
+	}
+	h[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// explain prints how the request would be routed with the config, nothing is proxied
+func explain(args []string) {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	var configPath string
+	req := proxy.ExplainRequest{Headers: headerFlags{}}
+	fs.StringVar(&configPath, "config", "", "path to the proxy config")
+	fs.StringVar(&req.Listener, "listener", "", "name of the http listener, required when there are several")
+	fs.StringVar(&req.Method, "method", "GET", "request method")
+	fs.StringVar(&req.URL, "url", "", "request URL or path")
+	fs.Var(headerFlags(req.Headers), "H", "request header as `Name: value`, can be repeated")
+	fs.StringVar(&req.ClientIP, "client-ip", "", "client IP used by the clientip conditions")
+	fs.Parse(args)
+	if configPath == "" || req.URL == "" {
+		log.Fatal("--config and --url are required fields to explain the route")
+	}
+
+	cfg, err := config.ReadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := proxy.ExplainRoute(cfg, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		log.Fatal(err)
+	}
+	if res.Error != "" {
+		os.Exit(1)
+	}
+}
+
 func main() {
 	// TODO: multiple targets
 	// TODO: redirect rules
 	// TODO: file config
 	// TODO: command line params
 	// TODO: hot reload
-	// TODO: logging
 	// TODO: tests
 	// TODO: graceful shutdown
 	// TODO: signals processing
-	// TODO: https
-	// TODO: metrics?
 	// TODO: healthchecks?
 	// TODO: targets autodiscovery?
 	// TODO: API for controlling
 	// TODO: Docker image
 
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		explain(os.Args[2:])
+		return
+	}
+
 	configPath := parseFlags()
 
 	cfg, err := config.ReadConfig(configPath)
@@ -43,7 +104,10 @@ func main() {
 		return
 	}
 
-	config.SetupLogging(cfg)
+	if err := config.SetupLogging(cfg); err != nil {
+		log.Fatal(err)
+		return
+	}
 
 	ps, err := proxy.NewProxyServer(cfg)
 	if err != nil {
@@ -51,7 +115,6 @@ func main() {
 		return
 	}
 
-	log.Warnf("Starting the server on port :%d\n", cfg.Port)
 	ps.Start()
 	log.Warn("Server stopped")
 }
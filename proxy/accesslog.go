@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// statusWriter captures the status and the number of bytes written to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Flush is required to stream gRPC and event-stream responses
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the original writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// getExchange returns the exchange the access log middleware has put into the context
+func getExchange(ctx context.Context) *exchange {
+	if ex, ok := ctx.Value(exchangeKey).(*exchange); ok {
+		return ex
+	}
+	return &exchange{}
+}
+
+// accessLogger writes one line per request
+type accessLogger struct {
+	out io.Writer
+
+	mu sync.RWMutex
+	// cfg is nil when the access log is disabled, it is replaced on reload
+	cfg *config.AccessLog
+}
+
+func newAccessLogger(cfg *config.AccessLog, out io.Writer) *accessLogger {
+	return &accessLogger{cfg: cfg, out: out}
+}
+
+func (l *accessLogger) setConfig(cfg *config.AccessLog) {
+	l.mu.Lock()
+	l.cfg = cfg
+	l.mu.Unlock()
+}
+
+func (l *accessLogger) getConfig() *config.AccessLog {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+func seconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1e6
+}
+
+func fieldValue(field string, r *http.Request, sw *statusWriter, ex *exchange, start time.Time, bytesIn int64) interface{} {
+	switch field {
+	case "time":
+		return start.Format(time.RFC3339Nano)
+	case "request_id":
+		return GetRequestID(r.Context())
+	case "client":
+		return clientAddr(r)
+	case "method":
+		return r.Method
+	case "host":
+		return r.Host
+	case "path":
+		return r.URL.RequestURI()
+	case "proto":
+		return r.Proto
+	case "status":
+		return sw.status
+	case "bytes_in":
+		return bytesIn
+	case "bytes_out":
+		return sw.bytes
+	case "duration":
+		return seconds(time.Since(start))
+	case "listener":
+		return ex.listener
+	case "route":
+		return ex.route
+	case "upstream":
+		return ex.upstream
+	case "server":
+		return ex.server
+	case "upstream_time":
+		return seconds(ex.upstreamTime)
+	case "error":
+		return ex.err
+	case "referer":
+		return r.Referer()
+	case "user_agent":
+		return r.UserAgent()
+	}
+	return nil
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+func formatAccessLog(cfg *config.AccessLog, r *http.Request, sw *statusWriter, ex *exchange, start time.Time, bytesIn int64) ([]byte, error) {
+	if cfg.Format == config.JSONFormat {
+		// Map keys are sorted by encoding/json, so the lines are easy to compare
+		entry := make(map[string]interface{}, len(cfg.Fields))
+		for _, f := range cfg.Fields {
+			entry[f] = fieldValue(f, r, sw, ex, start, bytesIn)
+		}
+		b, err := json.Marshal(entry)
+		return append(b, '\n'), err
+	}
+
+	var buf bytes.Buffer
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	fmt.Fprintf(&buf, "%s - %s [%s] %s %d %d %s %s",
+		clientAddr(r), user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+		sw.status, sw.bytes, strconv.Quote(orDash(r.Referer())), strconv.Quote(orDash(r.UserAgent())))
+	for _, f := range cfg.Fields {
+		v := fieldValue(f, r, sw, ex, start, bytesIn)
+		switch value := v.(type) {
+		case string:
+			v = strconv.Quote(orDash(value))
+		case float64:
+			v = strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		fmt.Fprintf(&buf, " %s=%v", f, v)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (l *accessLogger) write(r *http.Request, sw *statusWriter, ex *exchange, start time.Time, bytesIn int64) {
+	cfg := l.getConfig()
+	if cfg == nil {
+		return
+	}
+	line, err := formatAccessLog(cfg, r, sw, ex, start, bytesIn)
+	if err != nil {
+		log.Errorf("[ID:%s] Can not format access log entry: %s", logRequestID(r.Context()), err)
+		return
+	}
+	// Output serializes the writes itself
+	if _, err := l.out.Write(line); err != nil {
+		log.Errorf("Can not write access log: %s", err)
+	}
+}
+
+// accessLogging returns Middleware that writes the access log entry after the request is served
+// Proxy handler fills the exchange from the context with the upstream details
+func accessLogging(l *accessLogger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			ex := &exchange{}
+
+			body := &countingReader{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), exchangeKey, ex))
+			defer func() {
+				if sw.status == 0 {
+					sw.status = http.StatusOK
+				}
+				l.write(r, sw, ex, start, body.count())
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
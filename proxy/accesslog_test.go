@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+// serveLogged serves the request that failed on the upstream and returns the access log output
+func serveLogged(t *testing.T, cfg *config.AccessLog) string {
+	t.Helper()
+	var out bytes.Buffer
+	handler := accessLogging(newAccessLogger(cfg, &out))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		ex := getExchange(r.Context())
+		ex.listener, ex.route, ex.upstream, ex.server = "web", "api", "api-backup", "http://10.0.0.2:8080"
+		ex.upstreamTime = 1500 * time.Millisecond
+		ex.err = "connection refused"
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Bad Gateway"))
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/items?limit=1", strings.NewReader("payload"))
+	r.RemoteAddr = "192.0.2.1:5000"
+	r.Header.Set("User-Agent", "curl/8.0")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	return out.String()
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	line := serveLogged(t, &config.AccessLog{
+		Format: config.JSONFormat,
+		Fields: []string{"method", "path", "status", "bytes_in", "bytes_out", "route", "upstream", "server", "upstream_time", "error"},
+	})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("expected JSON line, got %q: %s", line, err)
+	}
+	want := map[string]interface{}{
+		"method":        "POST",
+		"path":          "/v1/items?limit=1",
+		"status":        float64(http.StatusBadGateway),
+		"bytes_in":      float64(len("payload")),
+		"bytes_out":     float64(len("Bad Gateway")),
+		"route":         "api",
+		"upstream":      "api-backup",
+		"server":        "http://10.0.0.2:8080",
+		"upstream_time": 1.5,
+		"error":         "connection refused",
+	}
+	if len(entry) != len(want) {
+		t.Errorf("expected only the selected fields, got %v", entry)
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	line := serveLogged(t, &config.AccessLog{Format: config.CombinedFormat, Fields: []string{"upstream", "upstream_time", "request_id"}})
+
+	pattern := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "POST /v1/items\?limit=1 HTTP/1\.1" 502 11 "-" "curl/8\.0" upstream="api-backup" upstream_time=1\.5 request_id="-"\n$`)
+	if !pattern.MatchString(line) {
+		t.Errorf("unexpected combined line %q", line)
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	if line := serveLogged(t, nil); line != "" {
+		t.Errorf("expected no access log, got %q", line)
+	}
+}
@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadHistorySize is the number of the recent reload results kept for the admin API
+const reloadHistorySize = 20
+
+type reloadResult struct {
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"durationSeconds"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// reloadHistory keeps the recent reload results, the oldest ones are dropped
+type reloadHistory struct {
+	mu      sync.Mutex
+	results []reloadResult
+}
+
+func (h *reloadHistory) add(start time.Time, err error) {
+	r := reloadResult{Time: start, Duration: seconds(time.Since(start)), Success: err == nil}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results = append(h.results, r)
+	if len(h.results) > reloadHistorySize {
+		h.results = h.results[len(h.results)-reloadHistorySize:]
+	}
+}
+
+// list returns the results starting from the latest one
+func (h *reloadHistory) list() []reloadResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]reloadResult, 0, len(h.results))
+	for i := len(h.results) - 1; i >= 0; i-- {
+		list = append(list, h.results[i])
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Can not encode admin response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// readOnly rejects the requests that try to change the state with the read-only endpoint
+func readOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	list := make([]string, 0, len(nets))
+	for _, n := range nets {
+		list = append(list, n.String())
+	}
+	return list
+}
+
+type upstreamConfigView struct {
+	config.Upstr
+	Servers []string
+}
+
+type tracingConfigView struct {
+	*config.Tracing
+	Headers map[string]string
+}
+
+type adminConfigView struct {
+	*config.Admin
+	Tokens []string
+	Users  []string
+	Allow  []string
+}
+
+// configView is the Config with the server URLs and networks in the readable form
+// Values of the tracing headers and the admin secrets are hidden, only the names are shown
+type configView struct {
+	*config.Config
+	TrustedProxies []string
+	Tracing        *tracingConfigView
+	Admin          *adminConfigView
+	Upstreams      []upstreamConfigView
+}
+
+func newConfigView(cfg *config.Config) configView {
+	v := configView{Config: cfg, TrustedProxies: ipNetStrings(cfg.TrustedProxies)}
+	if cfg.Tracing != nil {
+		v.Tracing = &tracingConfigView{Tracing: cfg.Tracing, Headers: make(map[string]string, len(cfg.Tracing.Headers))}
+		for k := range cfg.Tracing.Headers {
+			v.Tracing.Headers[k] = "<redacted>"
+		}
+	}
+	if cfg.Admin != nil {
+		v.Admin = &adminConfigView{Admin: cfg.Admin, Tokens: []string{}, Users: []string{}, Allow: ipNetStrings(cfg.Admin.Allow)}
+		for name := range cfg.Admin.Tokens {
+			v.Admin.Tokens = append(v.Admin.Tokens, name)
+		}
+		for name := range cfg.Admin.Users {
+			v.Admin.Users = append(v.Admin.Users, name)
+		}
+		sort.Strings(v.Admin.Tokens)
+		sort.Strings(v.Admin.Users)
+	}
+	for _, u := range cfg.Upstreams {
+		uv := upstreamConfigView{Upstr: u}
+		for _, s := range u.Servers {
+			uv.Servers = append(uv.Servers, newServer(s).String())
+		}
+		v.Upstreams = append(v.Upstreams, uv)
+	}
+	return v
+}
+
+type conditionView struct {
+	Type  string `json:"type"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value"`
+}
+
+func newConditionView(c config.Cond) conditionView {
+	return conditionView{Type: string(c.Type), Key: c.Key, Value: c.Value}
+}
+
+type routeView struct {
+	Upstream  string        `json:"upstream"`
+	Condition conditionView `json:"condition"`
+	Spillover string        `json:"spillover,omitempty"`
+}
+
+type hostRoutesView struct {
+	Names  []string    `json:"names"`
+	Routes []routeView `json:"routes"`
+}
+
+type listenerRoutesView struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	// Hosts are matched first, Routes are used when none of the hosts match
+	Hosts  []hostRoutesView `json:"hosts,omitempty"`
+	Routes []routeView      `json:"routes,omitempty"`
+	// Upstream is set for tcp and udp listeners
+	Upstream string `json:"upstream,omitempty"`
+}
+
+func routeViews(names []string, upstreams map[string]config.Upstr) []routeView {
+	list := make([]routeView, 0, len(names))
+	for _, n := range names {
+		u := upstreams[n]
+		list = append(list, routeView{Upstream: n, Condition: newConditionView(u.Condition), Spillover: u.Spillover})
+	}
+	return list
+}
+
+// newRoutesView lists the routes of the listeners in the order they are matched
+func newRoutesView(cfg *config.Config) []listenerRoutesView {
+	upstreams := make(map[string]config.Upstr, len(cfg.Upstreams))
+	for _, u := range cfg.Upstreams {
+		upstreams[u.Name] = u
+	}
+	list := make([]listenerRoutesView, 0, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		lv := listenerRoutesView{Name: l.Name, Protocol: string(l.Protocol), Address: l.Network + "://" + l.Address}
+		if l.Stream != nil {
+			lv.Upstream = l.Stream.Upstream
+		}
+		for _, h := range l.Hosts {
+			lv.Hosts = append(lv.Hosts, hostRoutesView{Names: h.Names, Routes: routeViews(h.Routes, upstreams)})
+		}
+		lv.Routes = routeViews(l.Routes, upstreams)
+		list = append(list, lv)
+	}
+	return list
+}
+
+type serverView struct {
+	Address string `json:"address"`
+	// Tier is the index of the server priority group, lower tiers are used first
+	Tier     int    `json:"tier"`
+	Healthy  bool   `json:"healthy"`
+	State    string `json:"state"`
+	Weight   int    `json:"weight"`
+	InFlight int64  `json:"inFlight"`
+	// Drained is set when the draining server has no requests in flight and can be stopped
+	Drained bool `json:"drained"`
+}
+
+type upstreamView struct {
+	Name string `json:"name"`
+	// Target is the upstream serving the requests now, it differs from Name on spillover
+	Target    string `json:"target"`
+	Spillover string `json:"spillover,omitempty"`
+	// ActiveTier is -1 when none of the tiers has enough healthy servers
+	ActiveTier        int          `json:"activeTier"`
+	MinHealthyPercent int          `json:"minHealthyPercent"`
+	HealthCheck       bool         `json:"healthCheck"`
+	Servers           []serverView `json:"servers"`
+}
+
+func newUpstreamView(u *upstream) upstreamView {
+	v := upstreamView{
+		Name:              u.name,
+		Target:            u.target().name,
+		ActiveTier:        -1,
+		MinHealthyPercent: u.minHealthyPercent,
+		HealthCheck:       u.healthCheck != nil,
+	}
+	if u.spillover != nil {
+		v.Spillover = u.spillover.name
+	}
+	active := u.activeTier()
+	_, tiers := u.pool()
+	for i, t := range tiers {
+		if t == active {
+			v.ActiveTier = i
+		}
+		for _, s := range t.servers {
+			sv := serverView{
+				Address:  s.String(),
+				Tier:     i,
+				Healthy:  s.isHealthy(),
+				State:    stateNames[s.getState()],
+				Weight:   s.getWeight(),
+				InFlight: atomic.LoadInt64(&s.inFlight),
+			}
+			sv.Drained = s.getState() == drainingState && sv.InFlight == 0
+			v.Servers = append(v.Servers, sv)
+		}
+	}
+	return v
+}
+
+func (p *Proxy) configHandler() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newConfigView(p.getConfig()))
+	})
+}
+
+func (p *Proxy) routesHandler() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newRoutesView(p.getConfig()))
+	})
+}
+
+func (p *Proxy) upstreamsHandler() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.RLock()
+		us := p.us
+		p.mu.RUnlock()
+
+		list := make([]upstreamView, 0, len(us))
+		for _, u := range us {
+			list = append(list, newUpstreamView(u))
+		}
+		writeJSON(w, http.StatusOK, list)
+	})
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*statusError); ok {
+		status = e.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// serversHandler manages the servers of the upstream at /-/upstreams/<name>/servers
+// POST adds the server, PATCH changes the state or weight and DELETE removes the server selected with the url parameter
+func (p *Proxy) serversHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/-/upstreams/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "servers" {
+			writeAdminError(w, newStatusError(http.StatusNotFound, "Unknown admin path %s", r.URL.Path))
+			return
+		}
+		name, address := parts[0], r.URL.Query().Get("url")
+
+		var change serverChange
+		if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&change); err != nil {
+				writeAdminError(w, newStatusError(http.StatusBadRequest, "Invalid request body: %s", err))
+				return
+			}
+		}
+
+		var u *upstream
+		var err error
+		switch {
+		case r.Method == http.MethodPost:
+			u, err = p.addServer(name, change)
+		case r.Method == http.MethodPatch && address != "":
+			u, err = p.updateServer(name, address, change)
+		case r.Method == http.MethodDelete && address != "":
+			u, err = p.removeServer(name, address)
+		case r.Method == http.MethodPatch || r.Method == http.MethodDelete:
+			err = newStatusError(http.StatusBadRequest, "Server url parameter is required")
+		default:
+			w.Header().Set("Allow", "POST, PATCH, DELETE")
+			err = newStatusError(http.StatusMethodNotAllowed, "%s", http.StatusText(http.StatusMethodNotAllowed))
+		}
+		// Change is applied when only the overlay file could not be saved, the error is still reported
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newUpstreamView(u))
+	}
+}
+
+// explainHandler shows how the request described in the body would be routed, nothing is proxied
+func (p *Proxy) explainHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeAdminError(w, newStatusError(http.StatusMethodNotAllowed, "%s", http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		var req ExplainRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			writeAdminError(w, newStatusError(http.StatusBadRequest, "Invalid request body: %s", err))
+			return
+		}
+		res, err := p.explain(req)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (p *ProxyServer) reloadsHandler() http.HandlerFunc {
+	return readOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.reloads.list())
+	})
+}
+
+// getAdminListener creates the listener of the admin API
+// It also serves the health and ready endpoints, so it can be used for the probes of the balancer itself
+func (p *ProxyServer) getAdminListener(cfg *config.Config) (*listener, error) {
+	ac := config.Listener{
+		Name:     "admin",
+		Network:  cfg.Admin.Network,
+		Address:  cfg.Admin.Address,
+		Protocol: config.HTTPProtocol,
+	}
+	l := &listener{cfg: ac, router: http.NewServeMux()}
+	// Health and readiness stay open for the probes
+	l.router.HandleFunc("/-/health", p.healthHandler())
+	l.router.HandleFunc("/-/ready", p.readyHandler())
+	l.router.HandleFunc("/-/reload", p.admin.protect("reload", true, p.reloadHandler()))
+	l.router.HandleFunc("/-/metrics", p.admin.protect("metrics", false, p.proxy.metricsHandler()))
+	l.router.HandleFunc("/-/config", p.admin.protect("config", false, p.proxy.configHandler()))
+	l.router.HandleFunc("/-/routes", p.admin.protect("routes", false, p.proxy.routesHandler()))
+	l.router.HandleFunc("/-/explain", p.admin.protect("explain", false, p.proxy.explainHandler()))
+	l.router.HandleFunc("/-/upstreams", p.admin.protect("upstreams", false, p.proxy.upstreamsHandler()))
+	l.router.HandleFunc("/-/upstreams/", p.admin.protect("servers", true, p.proxy.serversHandler()))
+	l.router.HandleFunc("/-/reloads", p.admin.protect("reloads", false, p.reloadsHandler()))
+
+	server, err := getServer(cfg, l.router, realIP(p.proxy), tracing(p.proxy))
+	if err != nil {
+		return nil, err
+	}
+	l.server = server
+
+	if cfg.Admin.TLS != nil {
+		store, err := newCertStore(cfg.Admin.TLS)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can not configure TLS for the admin listener")
+		}
+		l.cfg.TLS = cfg.Admin.TLS
+		l.cfg.Protocol = config.HTTPSProtocol
+		l.certs = store
+		l.server.TLSConfig = getTLSConfig(cfg.Admin.TLS, store)
+	}
+	return l, nil
+}
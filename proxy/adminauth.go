@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminGuard authenticates the callers of the admin endpoints and writes the audit log
+type adminGuard struct {
+	mu sync.RWMutex
+	// cfg is nil when the admin endpoints are not restricted
+	cfg   *config.Admin
+	audit io.Writer
+}
+
+func newAdminGuard(cfg *config.Admin, audit io.Writer) *adminGuard {
+	warnUnauthenticated(cfg)
+	return &adminGuard{cfg: cfg, audit: audit}
+}
+
+// warnUnauthenticated reports that the reload and the server changes are denied
+// They were served anonymously before the admin authentication was added
+func warnUnauthenticated(cfg *config.Admin) {
+	if cfg == nil || !cfg.Authenticated() {
+		log.Warn("Admin authentication is not configured, reload and the other admin changes are denied, set admin tokens, users or client certificates")
+	}
+}
+
+// setConfig replaces the tokens, users and allow list on reload
+// Admin section and the credentials can not be removed without restart, so the reload is never locked out by mistake
+func (g *adminGuard) setConfig(cfg *config.Admin) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cfg != nil && cfg == nil {
+		log.Warn("Admin section is removed from the config, the previous admin settings are kept until restart")
+		return
+	}
+	if g.cfg != nil && g.cfg.Authenticated() && !cfg.Authenticated() {
+		log.Warn("Admin credentials are removed from the config, the previous admin settings are kept until restart")
+		return
+	}
+	g.cfg = cfg
+}
+
+func (g *adminGuard) getConfig() *config.Admin {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.cfg
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// authenticate returns the identity of the caller or the error with the response status
+// Mutating endpoints are never served anonymously, they require tokens, users or client certificates
+func (g *adminGuard) authenticate(r *http.Request, mutating bool) (string, error) {
+	cfg := g.getConfig()
+	if cfg != nil {
+		ip := config.ClientIP(r)
+		if len(cfg.Allow) != 0 && (ip == nil || !ipInNets(ip, cfg.Allow)) {
+			return "", newStatusError(http.StatusForbidden, "Client %s is not allowed to use the admin endpoints", clientAddr(r))
+		}
+	}
+	if cfg == nil || !cfg.Authenticated() {
+		if mutating {
+			return "", newStatusError(http.StatusForbidden, "Admin authentication is not configured, set admin tokens, users or client certificates")
+		}
+		return "anonymous", nil
+	}
+
+	// Only the certificates verified against the admin clientCA are accepted
+	if cfg.TLS != nil && cfg.TLS.ClientAuth != tls.NoClientCert && r.TLS != nil {
+		if cert := config.ClientCertificate(r); cert != nil {
+			return "cert:" + cert.Subject.CommonName, nil
+		}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		for name, t := range cfg.Tokens {
+			if secretEqual(token, t) {
+				return "token:" + name, nil
+			}
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if p, known := cfg.Users[user]; known && secretEqual(password, p) {
+			return "user:" + user, nil
+		}
+	}
+	return "", newStatusError(http.StatusUnauthorized, "Authentication required")
+}
+
+// auditEntry is the line of the audit log
+type auditEntry struct {
+	Time      string `json:"time"`
+	Action    string `json:"action"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Caller    string `json:"caller"`
+	Client    string `json:"client"`
+	RequestID string `json:"request_id,omitempty"`
+	Status    int    `json:"status"`
+	// Outcome is success, failure or denied
+	Outcome string `json:"outcome"`
+}
+
+func (g *adminGuard) writeAudit(e auditEntry) {
+	requestID := e.RequestID
+	if requestID == "" {
+		requestID = "unknown"
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("[ID:%s] Can not encode audit log entry: %s", requestID, err)
+		return
+	}
+	if _, err := g.audit.Write(append(line, '\n')); err != nil {
+		log.Errorf("[ID:%s] Can not write audit log entry: %s", requestID, err)
+	}
+}
+
+// protect returns the handler that serves only the allowed callers
+// Calls of the mutating endpoints are written to the audit log, including the denied ones
+func (g *adminGuard) protect(action string, mutating bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		caller, err := g.authenticate(r, mutating)
+		sw := &statusWriter{ResponseWriter: w}
+		if err != nil {
+			if e, ok := err.(*statusError); ok && e.status == http.StatusUnauthorized {
+				if cfg := g.getConfig(); len(cfg.Users) != 0 {
+					w.Header().Add("WWW-Authenticate", `Basic realm="loadbalancer"`)
+				}
+				w.Header().Add("WWW-Authenticate", `Bearer realm="loadbalancer"`)
+			}
+			writeAdminError(sw, err)
+		} else {
+			next(sw, r)
+		}
+		if !mutating {
+			return
+		}
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		outcome := "success"
+		switch {
+		case err != nil:
+			outcome, caller = "denied", "unknown"
+		case sw.status >= 400:
+			outcome = "failure"
+		}
+		g.writeAudit(auditEntry{
+			Time:      start.Format(time.RFC3339Nano),
+			Action:    action,
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Caller:    caller,
+			Client:    clientAddr(r),
+			RequestID: GetRequestID(r.Context()),
+			Status:    sw.status,
+			Outcome:   outcome,
+		})
+	}
+}
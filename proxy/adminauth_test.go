@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func adminRequest(clientIP string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/-/reload", nil)
+	return r.WithContext(config.ContextWithClientIP(r.Context(), net.ParseIP(clientIP)))
+}
+
+func withClientCert(r *http.Request, cn string) *http.Request {
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	token := "0123456789abcdef0123"
+	authenticated := &config.Admin{
+		Tokens: map[string]string{"deploy": token},
+		Users:  map[string]string{"ops": "secret"},
+		Allow:  mustCIDRs(t, "127.0.0.0/8", "10.0.0.0/8"),
+		TLS:    &config.TLS{ClientAuth: tls.VerifyClientCertIfGiven},
+	}
+
+	tests := []struct {
+		name     string
+		cfg      *config.Admin
+		mutating bool
+		request  func() *http.Request
+		caller   string
+		status   int
+	}{
+		{
+			name:    "no admin section, read only",
+			request: func() *http.Request { return adminRequest("127.0.0.1") },
+			caller:  "anonymous",
+		},
+		{
+			name:     "no admin section, mutating",
+			mutating: true,
+			request:  func() *http.Request { return adminRequest("127.0.0.1") },
+			status:   http.StatusForbidden,
+		},
+		{
+			name:     "allow list only, mutating",
+			cfg:      &config.Admin{Allow: mustCIDRs(t, "127.0.0.0/8")},
+			mutating: true,
+			request:  func() *http.Request { return adminRequest("127.0.0.1") },
+			status:   http.StatusForbidden,
+		},
+		{
+			name:    "allow list only, read only",
+			cfg:     &config.Admin{Allow: mustCIDRs(t, "127.0.0.0/8")},
+			request: func() *http.Request { return adminRequest("127.0.0.1") },
+			caller:  "anonymous",
+		},
+		{
+			name: "client outside of allow list",
+			cfg:  authenticated,
+			request: func() *http.Request {
+				r := adminRequest("192.168.1.1")
+				r.Header.Set("Authorization", "Bearer "+token)
+				return r
+			},
+			status: http.StatusForbidden,
+		},
+		{
+			name:     "no credentials",
+			cfg:      authenticated,
+			mutating: true,
+			request:  func() *http.Request { return adminRequest("127.0.0.1") },
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "valid token",
+			cfg:      authenticated,
+			mutating: true,
+			request: func() *http.Request {
+				r := adminRequest("10.1.2.3")
+				r.Header.Set("Authorization", "Bearer "+token)
+				return r
+			},
+			caller: "token:deploy",
+		},
+		{
+			name:     "invalid token",
+			cfg:      authenticated,
+			mutating: true,
+			request: func() *http.Request {
+				r := adminRequest("127.0.0.1")
+				r.Header.Set("Authorization", "Bearer "+token+"x")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "valid basic auth",
+			cfg:      authenticated,
+			mutating: true,
+			request: func() *http.Request {
+				r := adminRequest("127.0.0.1")
+				r.SetBasicAuth("ops", "secret")
+				return r
+			},
+			caller: "user:ops",
+		},
+		{
+			name:     "invalid basic auth password",
+			cfg:      authenticated,
+			mutating: true,
+			request: func() *http.Request {
+				r := adminRequest("127.0.0.1")
+				r.SetBasicAuth("ops", "wrong")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown basic auth user",
+			cfg:      authenticated,
+			mutating: true,
+			request: func() *http.Request {
+				r := adminRequest("127.0.0.1")
+				r.SetBasicAuth("root", "secret")
+				return r
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "verified client certificate",
+			cfg:      authenticated,
+			mutating: true,
+			request:  func() *http.Request { return withClientCert(adminRequest("127.0.0.1"), "client") },
+			caller:   "cert:client",
+		},
+		{
+			name:     "client certificate without admin client auth",
+			cfg:      &config.Admin{Tokens: map[string]string{"deploy": token}},
+			mutating: true,
+			request:  func() *http.Request { return withClientCert(adminRequest("127.0.0.1"), "client") },
+			status:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newAdminGuard(tt.cfg, &bytes.Buffer{})
+			caller, err := g.authenticate(tt.request(), tt.mutating)
+			if tt.status != 0 {
+				e, ok := err.(*statusError)
+				if !ok || e.status != tt.status {
+					t.Fatalf("expected status %d, got caller %q and error %v", tt.status, caller, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if caller != tt.caller {
+				t.Fatalf("expected caller %q, got %q", tt.caller, caller)
+			}
+		})
+	}
+}
+
+func TestProtectAudit(t *testing.T) {
+	token := "0123456789abcdef0123"
+	cfg := &config.Admin{Tokens: map[string]string{"deploy": token}, Users: map[string]string{"ops": "secret"}}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	failed := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadRequest) }
+
+	tests := []struct {
+		name     string
+		mutating bool
+		handler  http.HandlerFunc
+		auth     string
+		status   int
+		// entry is nil when nothing should be audited
+		entry *auditEntry
+	}{
+		{
+			name:     "success",
+			mutating: true,
+			handler:  ok,
+			auth:     "Bearer " + token,
+			status:   http.StatusNoContent,
+			entry:    &auditEntry{Action: "reload", Caller: "token:deploy", Status: http.StatusNoContent, Outcome: "success"},
+		},
+		{
+			name:     "failure",
+			mutating: true,
+			handler:  failed,
+			auth:     "Bearer " + token,
+			status:   http.StatusBadRequest,
+			entry:    &auditEntry{Action: "reload", Caller: "token:deploy", Status: http.StatusBadRequest, Outcome: "failure"},
+		},
+		{
+			name:     "denied",
+			mutating: true,
+			handler:  ok,
+			status:   http.StatusUnauthorized,
+			entry:    &auditEntry{Action: "reload", Caller: "unknown", Status: http.StatusUnauthorized, Outcome: "denied"},
+		},
+		{
+			name:    "read only is not audited",
+			handler: ok,
+			auth:    "Bearer " + token,
+			status:  http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var audit bytes.Buffer
+			g := newAdminGuard(cfg, &audit)
+			r := adminRequest("127.0.0.1")
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			g.protect("reload", tt.mutating, tt.handler)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status == http.StatusUnauthorized {
+				challenges := strings.Join(w.Header()["Www-Authenticate"], ", ")
+				if !strings.Contains(challenges, "Basic") || !strings.Contains(challenges, "Bearer") {
+					t.Errorf("expected Basic and Bearer challenges, got %q", challenges)
+				}
+			}
+
+			if tt.entry == nil {
+				if audit.Len() != 0 {
+					t.Fatalf("expected no audit entry, got %s", audit.String())
+				}
+				return
+			}
+			var got auditEntry
+			if err := json.Unmarshal(audit.Bytes(), &got); err != nil {
+				t.Fatalf("can not decode audit entry %q: %s", audit.String(), err)
+			}
+			if got.Action != tt.entry.Action || got.Caller != tt.entry.Caller || got.Status != tt.entry.Status || got.Outcome != tt.entry.Outcome {
+				t.Errorf("unexpected audit entry %+v", got)
+			}
+			if got.Method != http.MethodPost || got.Path != "/-/reload" || got.Client != "127.0.0.1" || got.Time == "" {
+				t.Errorf("audit entry misses the request details %+v", got)
+			}
+		})
+	}
+}
+
+func TestAdminGuardSetConfig(t *testing.T) {
+	withTokens := &config.Admin{Tokens: map[string]string{"deploy": "0123456789abcdef0123"}}
+	allowOnly := &config.Admin{Allow: mustCIDRs(t, "10.0.0.0/8")}
+	rotated := &config.Admin{Tokens: map[string]string{"deploy": "abcdef0123456789abcd"}}
+	empty := &config.Admin{}
+
+	tests := []struct {
+		name    string
+		current *config.Admin
+		next    *config.Admin
+		want    *config.Admin
+	}{
+		{name: "tokens are rotated", current: withTokens, next: rotated, want: rotated},
+		{name: "admin section is added", next: withTokens, want: withTokens},
+		{name: "admin section is removed", current: withTokens, next: nil, want: withTokens},
+		{name: "credentials are removed", current: withTokens, next: allowOnly, want: withTokens},
+		{name: "allow list without credentials is replaced", current: allowOnly, next: empty, want: empty},
+		{name: "no admin section", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &adminGuard{cfg: tt.current}
+			g.setConfig(tt.next)
+			if got := g.getConfig(); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
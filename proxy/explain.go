@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+)
+
+// ExplainRequest describes the request to be routed without sending it anywhere
+type ExplainRequest struct {
+	// Listener can be omitted when the config has only one http listener
+	Listener string `json:"listener"`
+	Method   string `json:"method"`
+	// URL is the absolute URL or only the path with the query, e.g. /api/items?id=1
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// ClientIP is the resolved client address used by the clientip conditions, 127.0.0.1 by default
+	ClientIP string `json:"clientIp"`
+}
+
+// RouteEvaluation is the result of the route condition check
+type RouteEvaluation struct {
+	Upstream  string        `json:"upstream"`
+	Condition conditionView `json:"condition"`
+	Matched   bool          `json:"matched"`
+	Reason    string        `json:"reason"`
+}
+
+// ExplainResult shows how the request would be routed
+// Routes are listed in the order they are checked, up to the first matched one
+type ExplainResult struct {
+	Listener string `json:"listener"`
+	// Host is the request host used to select the virtual host
+	Host string `json:"host"`
+	// VirtualHost is empty when the default routes of the listener are used
+	VirtualHost []string          `json:"virtualHost,omitempty"`
+	Routes      []RouteEvaluation `json:"routes"`
+	// Route is the matched upstream, Upstream differs from it on spillover
+	Route    string `json:"route,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	Server   string `json:"server,omitempty"`
+	// URL and UpstreamHost are the URL and Host of the request sent to the server
+	URL          string `json:"url,omitempty"`
+	UpstreamHost string `json:"upstreamHost,omitempty"`
+	// Error is set when the request would be rejected by the balancer
+	Error string `json:"error,omitempty"`
+}
+
+func findHTTPListener(cfg *config.Config, name string) (config.Listener, error) {
+	var found []config.Listener
+	for _, l := range cfg.Listeners {
+		if l.Protocol != config.HTTPProtocol && l.Protocol != config.HTTPSProtocol {
+			if l.Name == name {
+				return l, newStatusError(http.StatusBadRequest, "Listener %s is %s, only http listeners have routes", name, l.Protocol)
+			}
+			continue
+		}
+		if name == "" || l.Name == name {
+			found = append(found, l)
+		}
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case name != "":
+		return config.Listener{}, newStatusError(http.StatusBadRequest, "Unknown listener %s", name)
+	case len(found) == 0:
+		return config.Listener{}, newStatusError(http.StatusBadRequest, "No http listeners configured")
+	}
+	return config.Listener{}, newStatusError(http.StatusBadRequest, "Listener is required, the config has %d http listeners", len(found))
+}
+
+// newExplainedRequest builds the request in the form it has after the middlewares of the listener
+func newExplainedRequest(l config.Listener, req ExplainRequest) (*http.Request, error) {
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Path == "" && u.Host == "") {
+		return nil, newStatusError(http.StatusBadRequest, "Invalid request url %q", req.URL)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	clientIP := net.IPv4(127, 0, 0, 1)
+	if req.ClientIP != "" {
+		if clientIP = net.ParseIP(req.ClientIP); clientIP == nil {
+			return nil, newStatusError(http.StatusBadRequest, "Invalid client IP %q", req.ClientIP)
+		}
+	}
+
+	r, err := http.NewRequest(method, u.RequestURI(), nil)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadRequest, "Invalid request: %s", err)
+	}
+	r.RequestURI = u.RequestURI()
+	r.Host = u.Host
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, "Host") {
+			r.Host = v
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	r.RemoteAddr = net.JoinHostPort(clientIP.String(), "0")
+	if l.Protocol == config.HTTPSProtocol {
+		r.TLS = &tls.ConnectionState{ServerName: requestHost(r)}
+	}
+	return r.WithContext(config.ContextWithClientIP(r.Context(), clientIP)), nil
+}
+
+// explainRoute evaluates the routes of the listener the same way the request would be handled
+// Server selection does not move the round robin, so the explained server is the next one to be used
+func explainRoute(cfg *config.Config, tables map[string]*routeTable, req ExplainRequest) (*ExplainResult, error) {
+	l, err := findHTTPListener(cfg, req.Listener)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := tables[l.Name]
+	if !ok {
+		return nil, errors.Errorf("No routes configured for listener %s", l.Name)
+	}
+	r, err := newExplainedRequest(l, req)
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := make(map[string]config.Upstr, len(cfg.Upstreams))
+	for _, cu := range cfg.Upstreams {
+		conditions[cu.Name] = cu
+	}
+
+	res := &ExplainResult{Listener: l.Name, Host: requestHost(r), Routes: []RouteEvaluation{}}
+	routes, vh := t.getRoutes(r)
+	if vh != nil {
+		res.VirtualHost = vh.names
+	}
+	var matched *upstream
+	for _, u := range routes {
+		ok := u.cond.Check(r)
+		res.Routes = append(res.Routes, RouteEvaluation{
+			Upstream:  u.name,
+			Condition: newConditionView(conditions[u.name].Condition),
+			Matched:   ok,
+			Reason:    u.cond.Explain(r),
+		})
+		if ok {
+			matched = u
+			break
+		}
+	}
+	if matched == nil {
+		res.Error = "No upstream matches the provided request"
+		return res, nil
+	}
+
+	res.Route = matched.name
+	target := matched.target()
+	res.Upstream = target.name
+	s, err := target.peekServer()
+	if err != nil {
+		res.Error = errors.Wrapf(err, "Can not get server for upstream %s", target.name).Error()
+		return res, nil
+	}
+	res.Server = s.String()
+	serverURL, err := target.serverURL(s, r.URL)
+	if err != nil {
+		res.Error = err.Error()
+		return res, nil
+	}
+	res.URL = serverURL.String()
+	res.UpstreamHost = target.requestHost(s, r.Host)
+	return res, nil
+}
+
+func (p *Proxy) explain(req ExplainRequest) (*ExplainResult, error) {
+	p.mu.RLock()
+	cfg, tables := p.cfg, p.tables
+	p.mu.RUnlock()
+	return explainRoute(cfg, tables, req)
+}
+
+// ExplainRoute explains the request routing using only the config and the overlay file
+// Health checks are not run, so all the servers are considered healthy
+func ExplainRoute(cfg *config.Config, req ExplainRequest) (*ExplainResult, error) {
+	upstreams, err := configureUpstreams(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Admin != nil {
+		overlay, err := config.ReadOverlay(cfg.Admin.Overlay)
+		if err != nil {
+			return nil, err
+		}
+		applyOverlay(cfg, upstreams, overlay)
+	}
+	tables, err := configureRouteTables(cfg, upstreams)
+	if err != nil {
+		return nil, err
+	}
+	return explainRoute(cfg, tables, req)
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExplainRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "explain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	overlay := `
+upstreams:
+  api:
+    overrides:
+      http://10.0.0.1:80: {state: disabled}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "overlay.yml"), []byte(overlay), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, dir, `
+listeners:
+  - name: web
+    address: 127.0.0.1:18080
+    routes: [internal, api, echo]
+    hosts:
+      - names: ["*.example.com"]
+        routes: [echo]
+upstreams:
+  internal:
+    servers: [10.0.1.1:80]
+    condition: {type: clientip, value: "10.0.0.0/8"}
+  api:
+    servers: [10.0.0.1:80, 10.0.0.2:80]
+    condition: {type: prefix, value: /api}
+    stripPrefix: /api
+    hostHeader: upstream
+  echo:
+    servers: [10.0.2.1:80]
+    condition: {type: prefix, value: /}
+admin:
+  address: 127.0.0.1:19000
+  overlay: `+filepath.Join(dir, "overlay.yml"))
+
+	tests := []struct {
+		name   string
+		req    ExplainRequest
+		routes []bool
+		route  string
+		server string
+		url    string
+		host   string
+	}{
+		{
+			name:   "disabled server of the overlay is skipped",
+			req:    ExplainRequest{URL: "http://lb.internal/api/items?id=1", ClientIP: "192.0.2.1"},
+			routes: []bool{false, true},
+			route:  "api",
+			server: "http://10.0.0.2:80",
+			url:    "http://10.0.0.2:80/items?id=1",
+			host:   "10.0.0.2:80",
+		},
+		{
+			name:   "client ip route",
+			req:    ExplainRequest{URL: "/api/items", ClientIP: "10.1.2.3"},
+			routes: []bool{true},
+			route:  "internal",
+			server: "http://10.0.1.1:80",
+			url:    "http://10.0.1.1:80/api/items",
+		},
+		{
+			name:   "virtual host routes",
+			req:    ExplainRequest{URL: "/api/items", Headers: map[string]string{"Host": "www.example.com"}},
+			routes: []bool{true},
+			route:  "echo",
+			server: "http://10.0.2.1:80",
+			url:    "http://10.0.2.1:80/api/items",
+			host:   "www.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ExplainRoute(cfg, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Error != "" {
+				t.Fatalf("unexpected error: %s", res.Error)
+			}
+			if len(res.Routes) != len(tt.routes) {
+				t.Fatalf("expected %d evaluated routes, got %+v", len(tt.routes), res.Routes)
+			}
+			for i, matched := range tt.routes {
+				if res.Routes[i].Matched != matched || res.Routes[i].Reason == "" {
+					t.Errorf("route %s: expected matched %v with the reason, got %+v", res.Routes[i].Upstream, matched, res.Routes[i])
+				}
+			}
+			if res.Route != tt.route || res.Server != tt.server || res.URL != tt.url {
+				t.Errorf("expected %s %s %s, got %s %s %s", tt.route, tt.server, tt.url, res.Route, res.Server, res.URL)
+			}
+			if tt.host != "" && res.UpstreamHost != tt.host {
+				t.Errorf("expected upstream host %s, got %s", tt.host, res.UpstreamHost)
+			}
+		})
+	}
+
+	// Running proxy explains the same way and the explained server is not consumed
+	p, err := NewProxy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := p.explain(tests[0].req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Server != tests[0].server {
+			t.Errorf("expected %s from the running proxy, got %s", tests[0].server, res.Server)
+		}
+	}
+
+	if _, err := ExplainRoute(cfg, ExplainRequest{Listener: "unknown", URL: "/"}); err == nil {
+		t.Error("expected an error for the unknown listener")
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// tier is the group of the upstream servers with the same priority
+type tier struct {
+	servers []*server
+
+	mu sync.Mutex
+	// current are the counters of the smooth weighted round robin, one per server
+	current []int
+}
+
+// buildTiers groups the servers by priority, the tiers are ordered from the most preferred one
+func buildTiers(servers []*server) []*tier {
+	byPriority := make(map[int]*tier)
+	var keys []int
+	for _, s := range servers {
+		t, ok := byPriority[s.priority]
+		if !ok {
+			t = &tier{}
+			byPriority[s.priority] = t
+			keys = append(keys, s.priority)
+		}
+		t.servers = append(t.servers, s)
+		t.current = append(t.current, 0)
+	}
+	sort.Ints(keys)
+
+	tiers := make([]*tier, 0, len(keys))
+	for _, p := range keys {
+		tiers = append(tiers, byPriority[p])
+	}
+	return tiers
+}
+
+// healthy returns the number of the servers that can receive the requests
+// and the number of the servers that are not taken out of the rotation on purpose
+func (t *tier) healthy() (int, int) {
+	var available, enabled int
+	for _, s := range t.servers {
+		if s.getState() != activeState {
+			continue
+		}
+		enabled++
+		if s.isHealthy() {
+			available++
+		}
+	}
+	return available, enabled
+}
+
+// next returns the available server of the tier
+// Servers are selected in the smooth weighted round robin order, as in nginx
+func (t *tier) next() *server {
+	return t.pick(true, nil)
+}
+
+// peek returns the server the next call would select without moving the round robin
+func (t *tier) peek() *server {
+	return t.pick(false, nil)
+}
+
+// pick selects the available server, the skipped servers are not considered
+func (t *tier) pick(commit bool, skip map[*server]bool) *server {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	best, total := -1, 0
+	var bestCurrent int
+	for i, s := range t.servers {
+		if !s.isAvailable() || skip[s] {
+			continue
+		}
+		w := s.getWeight()
+		current := t.current[i] + w
+		total += w
+		if best < 0 || current > bestCurrent {
+			best, bestCurrent = i, current
+		}
+		if commit {
+			t.current[i] = current
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	if commit {
+		t.current[best] -= total
+	}
+	return t.servers[best]
+}
+
+// pool returns the current servers and tiers of the upstream
+// They are replaced as a whole when the servers are added or removed at runtime
+func (u *upstream) pool() ([]*server, []*tier) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.servers, u.tiers
+}
+
+func (u *upstream) setPool(servers []*server) {
+	tiers := buildTiers(servers)
+	u.mu.Lock()
+	u.servers, u.tiers = servers, tiers
+	u.mu.Unlock()
+}
+
+// activeTier returns the first tier with enough healthy servers
+// Drained and disabled servers are not counted, so the maintenance does not cause the failover
+func (u *upstream) activeTier() *tier {
+	_, tiers := u.pool()
+	for _, t := range tiers {
+		available, enabled := t.healthy()
+		if available > 0 && available*100 >= u.minHealthyPercent*enabled {
+			return t
+		}
+	}
+	return nil
+}
+
+// target returns the upstream that should serve the request
+// It is the spillover upstream when none of the own tiers has enough healthy servers
+// Spillover is not chained, the spillover upstream uses only its own servers
+func (u *upstream) target() *upstream {
+	if u.spillover == nil || u.activeTier() != nil {
+		return u
+	}
+	_, tiers := u.spillover.pool()
+	for _, t := range tiers {
+		if available, _ := t.healthy(); available > 0 {
+			return u.spillover
+		}
+	}
+	return u
+}
+
+func (u *upstream) getServer() (*server, error) {
+	return u.selectServer((*tier).next)
+}
+
+// peekServer returns the server the next request would be sent to, the selection state is not changed
+func (u *upstream) peekServer() (*server, error) {
+	return u.selectServer((*tier).peek)
+}
+
+// nextServer returns the server that was not tried yet, it is used to retry the connection
+func (u *upstream) nextServer(tried map[*server]bool) (*server, error) {
+	return u.selectServer(func(t *tier) *server { return t.pick(true, tried) })
+}
+
+func (u *upstream) selectServer(next func(*tier) *server) (*server, error) {
+	servers, tiers := u.pool()
+	if len(servers) == 0 {
+		return nil, errors.New("Empty upstream servers list")
+	}
+	if t := u.activeTier(); t != nil {
+		if s := next(t); s != nil {
+			return s, nil
+		}
+	}
+	// Any healthy server is better than the error when the tiers are below the threshold
+	for _, t := range tiers {
+		if s := next(t); s != nil {
+			return s, nil
+		}
+	}
+	return nil, errors.New("No healthy servers in upstream")
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+// tieredServer describes the server of the test upstream
+type tieredServer struct {
+	address  string
+	priority int
+	weight   int32
+	down     bool
+}
+
+func tieredUpstream(name string, minHealthyPercent int, servers ...tieredServer) *upstream {
+	var addresses []string
+	for _, s := range servers {
+		addresses = append(addresses, s.address)
+	}
+	u := testUpstream(name, nil, addresses...)
+	u.minHealthyPercent = minHealthyPercent
+	pool, _ := u.pool()
+	for i, s := range servers {
+		pool[i].priority = s.priority
+		if s.weight != 0 {
+			pool[i].weight = s.weight
+		}
+		pool[i].setHealthy(!s.down)
+	}
+	// Tiers are built from the priorities
+	u.setPool(pool)
+	return u
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []tieredServer
+		// draining is the index of the server taken out of the rotation, -1 for none
+		draining int
+		want     string
+	}{
+		{
+			name:     "smooth order over the full cycle",
+			servers:  []tieredServer{{address: "a:80", weight: 5}, {address: "b:80", weight: 1}, {address: "c:80", weight: 1}},
+			draining: -1,
+			want:     "a a b a c a a",
+		},
+		{
+			name:     "equal weights",
+			servers:  []tieredServer{{address: "a:80"}, {address: "b:80"}, {address: "c:80"}},
+			draining: -1,
+			want:     "a b c a b c",
+		},
+		{
+			name:     "draining server is skipped",
+			servers:  []tieredServer{{address: "a:80", weight: 2}, {address: "b:80", weight: 1}, {address: "c:80", weight: 1}},
+			draining: 1,
+			want:     "a c a a c a",
+		},
+		{
+			name:     "unhealthy server is skipped",
+			servers:  []tieredServer{{address: "a:80", weight: 3}, {address: "b:80", weight: 1, down: true}},
+			draining: -1,
+			want:     "a a a a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tieredUpstream("api", 0, tt.servers...)
+			if tt.draining >= 0 {
+				servers, _ := u.pool()
+				servers[tt.draining].state = drainingState
+			}
+			var got []string
+			for range strings.Fields(tt.want) {
+				s, err := u.getServer()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, s.host)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, strings.Join(got, " "))
+			}
+		})
+	}
+}
+
+func TestTierPromotion(t *testing.T) {
+	tests := []struct {
+		name              string
+		minHealthyPercent int
+		servers           []tieredServer
+		// want are the hosts that may receive the requests
+		want string
+	}{
+		{
+			name:    "primary tier is healthy",
+			servers: []tieredServer{{address: "a:80"}, {address: "b:80"}, {address: "backup:80", priority: 1}},
+			want:    "a b",
+		},
+		{
+			name:              "primary tier above the threshold",
+			minHealthyPercent: 50,
+			servers:           []tieredServer{{address: "a:80"}, {address: "b:80", down: true}, {address: "backup:80", priority: 1}},
+			want:              "a",
+		},
+		{
+			name:              "primary tier below the threshold",
+			minHealthyPercent: 60,
+			servers:           []tieredServer{{address: "a:80"}, {address: "b:80", down: true}, {address: "backup:80", priority: 1}},
+			want:              "backup",
+		},
+		{
+			name:    "primary tier is down",
+			servers: []tieredServer{{address: "a:80", down: true}, {address: "b:80", priority: 1}, {address: "c:80", priority: 2}},
+			want:    "b",
+		},
+		{
+			name:              "every tier below the threshold uses any healthy server",
+			minHealthyPercent: 100,
+			servers:           []tieredServer{{address: "a:80"}, {address: "b:80", down: true}, {address: "c:80", priority: 1, down: true}, {address: "d:80", priority: 1}},
+			want:              "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tieredUpstream("api", tt.minHealthyPercent, tt.servers...)
+			allowed := strings.Fields(tt.want)
+			seen := make(map[string]bool)
+			for i := 0; i < 10; i++ {
+				s, err := u.getServer()
+				if err != nil {
+					t.Fatal(err)
+				}
+				seen[s.host] = true
+			}
+			if len(seen) != len(allowed) {
+				t.Errorf("expected servers %v, got %v", allowed, seen)
+			}
+			for _, h := range allowed {
+				if !seen[h] {
+					t.Errorf("expected server %s to be selected, got %v", h, seen)
+				}
+			}
+		})
+	}
+}
+
+func TestSpillover(t *testing.T) {
+	tests := []struct {
+		name      string
+		servers   []tieredServer
+		spillover []tieredServer
+		// want is the upstream that serves the request, empty when there are no servers
+		want string
+	}{
+		{
+			name:      "own servers are healthy",
+			servers:   []tieredServer{{address: "a:80"}, {address: "b:80", priority: 1, down: true}},
+			spillover: []tieredServer{{address: "s:80"}},
+			want:      "api",
+		},
+		{
+			name:      "backup tier is used before the spillover",
+			servers:   []tieredServer{{address: "a:80", down: true}, {address: "b:80", priority: 1}},
+			spillover: []tieredServer{{address: "s:80"}},
+			want:      "api",
+		},
+		{
+			name:      "every tier is down",
+			servers:   []tieredServer{{address: "a:80", down: true}, {address: "b:80", priority: 1, down: true}},
+			spillover: []tieredServer{{address: "s:80"}},
+			want:      "backup",
+		},
+		{
+			name:      "spillover is down too",
+			servers:   []tieredServer{{address: "a:80", down: true}},
+			spillover: []tieredServer{{address: "s:80", down: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tieredUpstream("api", 0, tt.servers...)
+			u.spillover = tieredUpstream("backup", 0, tt.spillover...)
+			target := u.target()
+			s, err := target.getServer()
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("expected no servers, got %s of %s", s, target.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target.name != tt.want {
+				t.Errorf("expected upstream %s, got %s", tt.want, target.name)
+			}
+		})
+	}
+}
+
+func TestPeekServer(t *testing.T) {
+	u := tieredUpstream("api", 0, tieredServer{address: "a:80", weight: 2}, tieredServer{address: "b:80"})
+	for _, want := range []string{"a", "b", "a"} {
+		peeked, err := u.peekServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := u.getServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peeked != s || s.host != want {
+			t.Errorf("expected peek and selection of %s, got %s and %s", want, peeked.host, s.host)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !go1.24
+
+package proxy
+
+// Go 1.24 or newer is required, http.Protocols is used for HTTP/2 over cleartext
+// The undefined name below makes the reason visible in the build error
+var _ = loadbalancerRequiresGo1_24
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gRPC status codes, see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// grpcHealthServing is the SERVING value of grpc.health.v1.HealthCheckResponse.ServingStatus
+const grpcHealthServing = 1
+
+// grpcStatusFromHTTP maps the HTTP status to the gRPC one
+// See https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcStatusFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// encodeGRPCMessage percent-encodes the message as required for the grpc-message header
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// writeGRPCError writes the proxy error as the gRPC Trailers-Only response,
+// so gRPC clients receive proper status instead of the protocol error
+func writeGRPCError(w http.ResponseWriter, status int, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcStatusFromHTTP(status)))
+	h.Set("Grpc-Message", encodeGRPCMessage(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcFrame wraps the protobuf message into the gRPC length-prefixed message without compression
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+// encodeHealthCheckRequest encodes grpc.health.v1.HealthCheckRequest{service}
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	msg := []byte{0x0a} // field 1, length-delimited
+	msg = binary.AppendUvarint(msg, uint64(len(service)))
+	return append(msg, service...)
+}
+
+// decodeHealthCheckResponse returns the status field of grpc.health.v1.HealthCheckResponse
+func decodeHealthCheckResponse(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("Health check response is too short")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("Compressed health check response is not supported")
+	}
+	msg := frame[5:]
+	if uint32(len(msg)) != binary.BigEndian.Uint32(frame[1:5]) {
+		return 0, errors.New("Health check response length mismatch")
+	}
+
+	var status uint64
+	for len(msg) != 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0, errors.New("Malformed health check response")
+		}
+		msg = msg[n:]
+
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0, errors.New("Malformed health check response")
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return 0, errors.New("Malformed health check response")
+			}
+			msg = msg[size:]
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return 0, errors.New("Malformed health check response")
+			}
+			msg = msg[n+int(l):]
+		default:
+			return 0, errors.Errorf("Unsupported wire type %d in health check response", tag&7)
+		}
+	}
+	return status, nil
+}
+
+// probeGRPC calls the standard grpc.health.v1.Health/Check of the server
+func probeGRPC(ctx context.Context, client *http.Client, s *server, service string) error {
+	body := grpcFrame(encodeHealthCheckRequest(service))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL()+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Can not create health check request")
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Trailers are filled only after the body is read
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Can not read health check response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Unexpected health check status %d", resp.StatusCode)
+	}
+
+	// Trailers-Only responses carry the status in headers
+	code := resp.Trailer.Get("Grpc-Status")
+	if code == "" {
+		code = resp.Header.Get("Grpc-Status")
+	}
+	if code != "0" {
+		return errors.Errorf("Health check failed with grpc-status %s: %s", code, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	status, err := decodeHealthCheckResponse(data)
+	if err != nil {
+		return err
+	}
+	if status != grpcHealthServing {
+		return errors.Errorf("Server is not serving, status %d", status)
+	}
+	return nil
+}
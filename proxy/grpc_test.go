@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestEncodeHealthCheckRequest(t *testing.T) {
+	tests := []struct {
+		service string
+		want    []byte
+	}{
+		{"", nil},
+		{"helloworld.Greeter", append([]byte{0x0a, 18}, "helloworld.Greeter"...)},
+		// Length above 127 takes two varint bytes
+		{string(bytes.Repeat([]byte("a"), 200)), append([]byte{0x0a, 0xc8, 0x01}, bytes.Repeat([]byte("a"), 200)...)},
+	}
+	for _, tt := range tests {
+		if got := encodeHealthCheckRequest(tt.service); !bytes.Equal(got, tt.want) {
+			t.Errorf("service %q: expected %x, got %x", tt.service, tt.want, got)
+		}
+	}
+}
+
+func TestGRPCFrame(t *testing.T) {
+	frame := grpcFrame([]byte{1, 2, 3})
+	want := []byte{0, 0, 0, 0, 3, 1, 2, 3}
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("expected %x, got %x", want, frame)
+	}
+}
+
+func TestDecodeHealthCheckResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		frame  []byte
+		status uint64
+		err    bool
+	}{
+		{name: "serving", frame: grpcFrame([]byte{0x08, 0x01}), status: 1},
+		{name: "not serving", frame: grpcFrame([]byte{0x08, 0x02}), status: 2},
+		{name: "service unknown", frame: grpcFrame([]byte{0x08, 0x03}), status: 3},
+		{name: "default status", frame: grpcFrame(nil), status: 0},
+		{
+			name: "unknown fields are skipped",
+			frame: grpcFrame([]byte{
+				0x12, 0x03, 'a', 'b', 'c', // field 2, length-delimited
+				0x19, 1, 2, 3, 4, 5, 6, 7, 8, // field 3, fixed64
+				0x25, 1, 2, 3, 4, // field 4, fixed32
+				0x28, 0x96, 0x01, // field 5, varint
+				0x08, 0x01,
+			}),
+			status: 1,
+		},
+		{name: "too short", frame: []byte{0, 0, 0}, err: true},
+		{name: "compressed", frame: []byte{1, 0, 0, 0, 2, 0x08, 0x01}, err: true},
+		{name: "length mismatch", frame: []byte{0, 0, 0, 0, 5, 0x08, 0x01}, err: true},
+		{name: "truncated varint", frame: grpcFrame([]byte{0x08, 0x80}), err: true},
+		{name: "truncated bytes", frame: grpcFrame([]byte{0x12, 0x05, 'a'}), err: true},
+		{name: "truncated fixed64", frame: grpcFrame([]byte{0x19, 1, 2}), err: true},
+		{name: "group wire type", frame: grpcFrame([]byte{0x0b}), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := decodeHealthCheckResponse(tt.frame)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got status %d", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if status != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, status)
+			}
+		})
+	}
+}
+
+func TestDecodeEncodedStatus(t *testing.T) {
+	for _, status := range []uint64{0, 1, 2, 3, 300} {
+		msg := binary.AppendUvarint([]byte{0x08}, status)
+		got, err := decodeHealthCheckResponse(grpcFrame(msg))
+		if err != nil || got != status {
+			t.Errorf("expected status %d, got %d %v", status, got, err)
+		}
+	}
+}
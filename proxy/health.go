@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *server) setHealthy(h bool) bool {
+	var v int32 = 0
+	if h {
+		v = 1
+	}
+	// Report only the actual state changes
+	return atomic.SwapInt32(&s.healthy, v) != v
+}
+
+func probeHTTP(ctx context.Context, client *http.Client, s *server, host, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL()+path, nil)
+	if err != nil {
+		return errors.Wrap(err, "Can not create health check request")
+	}
+	req.Host = host
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return errors.Errorf("Unexpected health check status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, s *server) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network(), s.address())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (u *upstream) probe(s *server) error {
+	hc := u.healthCheck
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	switch hc.Type {
+	case config.GRPCHealthCheck:
+		return probeGRPC(ctx, u.client, s, hc.Service)
+	case config.TCPHealthCheck:
+		return probeTCP(ctx, s)
+	default:
+		// Servers validating the Host should accept the probes too
+		return probeHTTP(ctx, u.client, s, u.requestHost(s, s.authority()), hc.Path)
+	}
+}
+
+// checkServer probes the server until it is removed or the upstream is stopped
+// The first probe is made right away, the server state is changed only after
+// the configured number of consecutive probes with the same result
+func (u *upstream) checkServer(s *server) {
+	hc := u.healthCheck
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-u.stop:
+				return
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+
+		err := u.probe(s)
+		if err == nil {
+			successes, failures = successes+1, 0
+			if successes >= hc.HealthyThreshold && s.setHealthy(true) {
+				log.Warnf("Server %s of upstream %s is healthy", s, u.name)
+			}
+			continue
+		}
+
+		successes, failures = 0, failures+1
+		if failures >= hc.UnhealthyThreshold && s.setHealthy(false) {
+			log.Warnf("Server %s of upstream %s is unhealthy: %s", s, u.name, err)
+		}
+	}
+}
+
+func (u *upstream) startHealthChecks() {
+	if u.healthCheck == nil {
+		return
+	}
+	servers, _ := u.pool()
+	for _, s := range servers {
+		go u.checkServer(s)
+	}
+}
+
+// inheritHealth copies the health of the servers known to the old upstream with the same name
+// Otherwise the reload would send the traffic to the dead servers until they fail the checks again
+func (u *upstream) inheritHealth(old []*upstream) {
+	if u.healthCheck == nil {
+		return
+	}
+	for _, o := range old {
+		if o.name != u.name || o.healthCheck == nil {
+			continue
+		}
+		oldServers, _ := o.pool()
+		servers, _ := u.pool()
+		for _, s := range servers {
+			if _, prev := findServer(oldServers, s.String()); prev != nil {
+				atomic.StoreInt32(&s.healthy, atomic.LoadInt32(&prev.healthy))
+			}
+		}
+	}
+}
+
+func (u *upstream) stopHealthChecks() {
+	close(u.stop)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func testUpstream(name string, hc *config.HealthCheck, addresses ...string) *upstream {
+	u := &upstream{name: name, healthCheck: hc, stop: make(chan struct{})}
+	var servers []*server
+	for _, a := range addresses {
+		servers = append(servers, newServer(url.URL{Scheme: "http", Host: a}))
+	}
+	u.setPool(servers)
+	return u
+}
+
+func TestInheritHealth(t *testing.T) {
+	hc := &config.HealthCheck{Type: config.HTTPHealthCheck}
+	old := testUpstream("api", hc, "10.0.0.1:80", "10.0.0.2:80")
+	oldServers, _ := old.pool()
+	oldServers[1].setHealthy(false)
+
+	tests := []struct {
+		name string
+		u    *upstream
+		old  []*upstream
+		// want is the health of the new servers in order
+		want []bool
+	}{
+		{
+			name: "known servers keep their health",
+			u:    testUpstream("api", hc, "10.0.0.2:80", "10.0.0.1:80", "10.0.0.3:80"),
+			old:  []*upstream{old},
+			want: []bool{false, true, true},
+		},
+		{
+			name: "other upstream is ignored",
+			u:    testUpstream("web", hc, "10.0.0.2:80"),
+			old:  []*upstream{old},
+			want: []bool{true},
+		},
+		{
+			name: "health check is removed",
+			u:    testUpstream("api", nil, "10.0.0.2:80"),
+			old:  []*upstream{old},
+			want: []bool{true},
+		},
+		{
+			name: "health check is added",
+			u:    testUpstream("api", hc, "10.0.0.2:80"),
+			old:  []*upstream{testUpstream("api", nil, "10.0.0.2:80")},
+			want: []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.u.inheritHealth(tt.old)
+			servers, _ := tt.u.pool()
+			for i, s := range servers {
+				if s.isHealthy() != tt.want[i] {
+					t.Errorf("server %s: expected healthy %v", s, tt.want[i])
+				}
+			}
+		})
+	}
+}
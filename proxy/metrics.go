@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exposed in the Prometheus text format
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	counterMetric   = "counter"
+	gaugeMetric     = "gauge"
+	histogramMetric = "histogram"
+)
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// series is the single combination of the label values
+type series struct {
+	values []string
+	value  float64
+	// counts are the cumulative counts of the histogram buckets
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricVec holds all the series of the metric
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogramVec(name, help string, labels ...string) *metricVec {
+	v := newMetricVec(histogramMetric, name, help, labels...)
+	v.buckets = defaultBuckets
+	return v
+}
+
+// get returns the series for the label values, mu should be held
+func (v *metricVec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: values}
+		if v.kind == histogramMetric {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+func (v *metricVec) inc(values ...string) {
+	v.add(1, values...)
+}
+
+func (v *metricVec) observe(d time.Duration, values ...string) {
+	seconds := d.Seconds()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(values)
+	for i, b := range v.buckets {
+		if seconds <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != histogramMetric {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.value))
+			continue
+		}
+		for i, b := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.values, "le", formatValue(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.values), s.count)
+	}
+}
+
+var (
+	requestsTotal = newMetricVec(counterMetric, "lb_requests_total",
+		"Number of the proxied requests by the status class.", "listener", "route", "upstream", "code")
+	requestDuration = newHistogramVec("lb_request_duration_seconds",
+		"Total time of the request processing including the response copy.", "listener", "route")
+	upstreamDuration = newHistogramVec("lb_upstream_duration_seconds",
+		"Time until the response headers are received from the server.", "upstream", "server")
+	requestsInFlight = newMetricVec(gaugeMetric, "lb_requests_in_flight",
+		"Number of the requests being processed.", "listener")
+	requestBytes = newMetricVec(counterMetric, "lb_request_bytes_total",
+		"Request body bytes received from the clients.", "listener", "route")
+	responseBytes = newMetricVec(counterMetric, "lb_response_bytes_total",
+		"Response body bytes sent to the clients.", "listener", "route")
+	upstreamRetries = newMetricVec(counterMetric, "lb_upstream_retries_total",
+		"TCP listener connections sent to another server after the dial error, HTTP requests are not retried.", "upstream")
+	configReloads = newMetricVec(counterMetric, "lb_config_reloads_total",
+		"Config reloads by the result.", "result")
+	streamConnections = newMetricVec(counterMetric, "lb_stream_connections_total",
+		"Connections accepted by the tcp listeners and sessions created by the udp listeners.", "listener", "protocol")
+	streamActive = newMetricVec(gaugeMetric, "lb_stream_connections_active",
+		"Number of the proxied tcp connections and udp sessions.", "listener", "protocol")
+
+	registry = []*metricVec{
+		requestsTotal, requestDuration, upstreamDuration, requestsInFlight,
+		requestBytes, responseBytes, upstreamRetries, configReloads,
+		streamConnections, streamActive,
+	}
+)
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// recordReload counts the config reload result
+func recordReload(err error) {
+	if err != nil {
+		configReloads.inc("failure")
+		return
+	}
+	configReloads.inc("success")
+}
+
+// writeServerState reports the health and the requests in flight of the current upstream servers
+// It is collected on scrape, so the servers removed on reload disappear
+func (p *Proxy) writeServerState(w io.Writer) {
+	p.mu.RLock()
+	us := p.us
+	p.mu.RUnlock()
+
+	healthy := newMetricVec(gaugeMetric, "lb_server_healthy", "1 when the server passes the health checks.", "upstream", "server")
+	inFlight := newMetricVec(gaugeMetric, "lb_server_in_flight",
+		"Number of the requests and connections the server is handling.", "upstream", "server")
+	for _, u := range us {
+		servers, _ := u.pool()
+		for _, s := range servers {
+			var h float64
+			if s.isHealthy() {
+				h = 1
+			}
+			healthy.add(h, u.name, s.String())
+			inFlight.add(float64(atomic.LoadInt64(&s.inFlight)), u.name, s.String())
+		}
+	}
+	healthy.write(w)
+	inFlight.write(w)
+}
+
+func (p *Proxy) metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range registry {
+			m.write(w)
+		}
+		p.writeServerState(w)
+	}
+}
+
+// countingReader counts the bytes of the request body read by the transport
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	// Body might be still sent by the transport when the response is received
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -4,8 +4,8 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/electroprovodka/loadbalancer/config"
 	"github.com/rs/xid"
-	log "github.com/sirupsen/logrus"
 )
 
 // Middleware is a function that accepts allows to add additional behavior to the request processing cycle
@@ -14,21 +14,35 @@ type Middleware func(next http.Handler) http.Handler
 
 type key int
 
-var requestIDKey key = 0
+var (
+	requestIDKey key = 0
+	// trustedPeerKey marks the requests received from the trusted proxies
+	trustedPeerKey key = 1
+	// exchangeKey holds the details of the proxied request for the access log
+	exchangeKey key = 2
+	// spanKey holds the server span of the traced request
+	spanKey key = 3
+)
 
 func newRequestID() string {
 	return xid.New().String()
 }
 
+// GetRequestID returns the ID assigned by the tracing middleware
+// It is empty for the requests that did not pass through it
 func GetRequestID(ctx context.Context) string {
-	requestID, ok := ctx.Value(requestIDKey).(string)
-	if !ok {
-		// TODO: generate new ID?
-		requestID = "unknown"
-	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
 	return requestID
 }
 
+// logRequestID returns the request ID for the log lines and error responses, "unknown" when it is not assigned
+func logRequestID(ctx context.Context) string {
+	if requestID := GetRequestID(ctx); requestID != "" {
+		return requestID
+	}
+	return "unknown"
+}
+
 // Apply list of middlewares for router
 // Note: we apply middlewares the way that the first middleware in list will be the firs middleware to receive the request
 func applyMiddlewares(router http.Handler, middlewares []Middleware) http.Handler {
@@ -40,26 +54,34 @@ func applyMiddlewares(router http.Handler, middlewares []Middleware) http.Handle
 	return router
 }
 
-func tracing(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestID := r.Header.Get("X-Request-Id")
-		if requestID == "" {
-			requestID = newRequestID()
-		}
-		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-		r.Header.Set("X-Request-Id", requestID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// trustRequestID reports whether the request ID sent by the peer can be used
+func trustRequestID(r *http.Request, rc *config.RequestID) bool {
+	switch rc.Trust {
+	case config.TrustAlways:
+		return true
+	case config.TrustProxies:
+		fromProxy, _ := r.Context().Value(trustedPeerKey).(bool)
+		return fromProxy
+	}
+	return false
 }
 
-func logging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			requestID := GetRequestID(r.Context())
-			// TODO: log response code
-			// TODO: log the target redirect
-			log.Infof("[ID:%s] %s %s, %s, %s", requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
-		}()
-		next.ServeHTTP(w, r)
-	})
+// tracing returns Middleware that assigns the request ID, passes it to the upstream and echoes it to the client
+// Incoming IDs that are not trusted or not valid are replaced with the new ones
+func tracing(p *Proxy) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rc := p.getRequestIDConfig()
+			requestID := r.Header.Get(rc.Header)
+			if !trustRequestID(r, rc) || !rc.ValidRequestID(requestID) {
+				requestID = newRequestID()
+			}
+			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+			r.Header.Set(rc.Header, requestID)
+			if rc.Echo {
+				w.Header().Set(rc.Header, requestID)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLogRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "assigned ID", ctx: context.WithValue(context.Background(), requestIDKey, "c9h1m2"), want: "c9h1m2"},
+		{name: "request without ID", ctx: context.Background(), want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logRequestID(tt.ctx); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+			if tt.want == "unknown" && GetRequestID(tt.ctx) != "" {
+				t.Errorf("GetRequestID should stay empty for the request without ID")
+			}
+		})
+	}
+}
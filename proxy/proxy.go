@@ -1,13 +1,14 @@
 package proxy
 
 import (
-	"bytes"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/electroprovodka/loadbalancer/config"
@@ -21,54 +22,238 @@ type server struct {
 	scheme string
 	host   string
 	port   string
+	// socket is the path of the unix domain socket, host is only a placeholder for the transport then
+	socket string
+	// healthy is 1 when the server passes the health checks
+	// New servers are considered healthy until they fail the checks, the reloaded ones keep their health
+	healthy int32
+	// inFlight is the number of requests and connections the server is handling
+	inFlight int64
+	// state and weight can be changed at runtime with the admin API
+	state    int32
+	weight   int32
+	priority int
+	// stop is closed when the server is removed from the upstream
+	stop chan struct{}
 }
 
-// TODO: add weights?
 // TODO: add specific timeouts for each upstream?
 type upstream struct {
-	cond    config.Condition
+	cond   config.Condition
+	name   string
+	client *http.Client
+
+	// mu guards servers and tiers, which are replaced when the servers are changed at runtime
+	mu      sync.RWMutex
 	servers []*server
-	idx     int
-	name    string
+	// tiers are the servers grouped by priority, used in order
+	tiers             []*tier
+	minHealthyPercent int
+	// spillover is nil when the upstream does not fall back to another one
+	spillover *upstream
+	// critical upstreams are required for the readiness
+	critical bool
+
+	// hostHeader is the config.HostHeader mode or the literal host
+	hostHeader string
+	// stripPrefix is removed from the request path before it is sent to the server
+	stripPrefix string
+	// rewriteResponses enables mapping of the server addresses in the response headers
+	rewriteResponses bool
+	healthCheck      *config.HealthCheck
+	// stop is closed when the upstream is replaced on reload
+	stop chan struct{}
+}
+
+// virtualHost is the routing table selected by the request host
+type virtualHost struct {
+	names  []string
+	routes []*upstream
+}
+
+// routeTable holds the routes of a single listener
+type routeTable struct {
+	// routes are used when none of the hosts match the request
+	routes []*upstream
+	hosts  []*virtualHost
 }
 
 // Proxy is struct for managing the redirect settings
 type Proxy struct {
-	us           []*upstream
-	proxyTimeout time.Duration
+	// mu guards the fields below, which are replaced on reload
+	mu     sync.RWMutex
+	us     []*upstream
+	tables map[string]*routeTable
+	// trusted are the networks of the proxies allowed to set the forwarded headers
+	trusted   []*net.IPNet
+	requestID *config.RequestID
+	// cfg is the config the upstreams and routes were built from
+	cfg *config.Config
+
+	// overlayMu serializes the server changes made at runtime and the reloads that apply them
+	overlayMu   sync.Mutex
+	overlay     *config.Overlay
+	overlayPath string
+
+	tracer *tracer
 }
 
+func newServer(u url.URL) *server {
+	if u.Scheme == "unix" {
+		return &server{scheme: "http", host: socketHost(u.Path), port: "80", socket: u.Path, healthy: 1, weight: 1, stop: make(chan struct{})}
+	}
+	return &server{scheme: u.Scheme, host: u.Hostname(), port: u.Port(), healthy: 1, weight: 1, stop: make(chan struct{})}
+}
+
+func (s server) network() string {
+	if s.socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// address returns host:port or socket path suitable for net.Dial
+func (s server) address() string {
+	if s.socket != "" {
+		return s.socket
+	}
+	return net.JoinHostPort(s.host, s.port)
+}
+
+// authority is the host:port of the server for the Host header, socket servers have no host so localhost is used
+func (s server) authority() string {
+	if s.socket != "" {
+		return "localhost"
+	}
+	return s.address()
+}
+
+// URL is used to build the requests to the server
 func (s server) URL() string {
-	return s.scheme + "://" + s.host + ":" + s.port
+	return s.scheme + "://" + net.JoinHostPort(s.host, s.port)
+}
+
+func (s server) String() string {
+	if s.socket != "" {
+		return "unix://" + s.socket
+	}
+	return s.URL()
+}
+
+// requestHost returns the Host sent to the server instead of the client one
+func (u *upstream) requestHost(s *server, host string) string {
+	switch u.hostHeader {
+	case config.PreserveHost:
+		return host
+	case config.UpstreamHost:
+		return s.authority()
+	}
+	return u.hostHeader
+}
+
+func (s *server) isHealthy() bool {
+	return atomic.LoadInt32(&s.healthy) == 1
+}
+
+// acquire counts the request sent to the server until the returned function is called
+func (s *server) acquire() func() {
+	atomic.AddInt64(&s.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&s.inFlight, -1)
+	}
+}
+
+func (vh *virtualHost) matches(host string) bool {
+	for _, n := range vh.names {
+		if n == host {
+			return true
+		}
+		// Wildcard matches exactly one or more leading labels: *.example.com matches a.example.com
+		if strings.HasPrefix(n, "*.") && strings.HasSuffix(host, n[1:]) && len(host) > len(n)-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lowercase host of the request without port
+// SNI is used only when the request came without Host
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if host == "" && r.TLS != nil {
+		host = r.TLS.ServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// getRoutes returns the routes of the matched virtual host, the host is nil when the default routes are used
+func (t *routeTable) getRoutes(r *http.Request) ([]*upstream, *virtualHost) {
+	if len(t.hosts) != 0 {
+		host := requestHost(r)
+		for _, vh := range t.hosts {
+			if vh.matches(host) {
+				return vh.routes, vh
+			}
+		}
+	}
+	return t.routes, nil
 }
 
-func (u *upstream) getServer() (*server, error) {
-	if len(u.servers) == 0 {
-		return nil, errors.New("Empty upstream servers list")
+func (p *Proxy) getRouteTable(listener string) (*routeTable, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	t, ok := p.tables[listener]
+	if !ok {
+		return nil, errors.Errorf("No routes configured for listener %s", listener)
 	}
-	// TODO: find better way for round robin
-	s := u.servers[u.idx%len(u.servers)]
-	u.idx++
-	return s, nil
+	return t, nil
 }
 
-func (p *Proxy) getClient() (http.Client, error) {
-	// TODO: reuse same client for multiple requests
-	// TODO: Read/Write buffers sizes
-	// TODO: setup more timeouts if needed https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
-	// TODO: build manual timeout with context?
-	client := http.Client{
-		// NOTE: this timeout includes the response body read
-		Timeout: p.proxyTimeout,
+func (p *Proxy) getTrustedProxies() []*net.IPNet {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.trusted
+}
+
+func (p *Proxy) getConfig() *config.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg
+}
+
+func (p *Proxy) getRequestIDConfig() *config.RequestID {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.requestID
+}
+
+// getNamedUpstream returns the current upstream by its name
+func (p *Proxy) getNamedUpstream(name string) (*upstream, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, u := range p.us {
+		if u.name == name {
+			return u, nil
+		}
 	}
-	return client, nil
+	return nil, errors.Errorf("Unknown upstream %s", name)
 }
 
-func (p *Proxy) getUpstream(r *http.Request) (*upstream, error) {
-	for idx := range p.us {
+func (p *Proxy) getUpstream(listener string, r *http.Request) (*upstream, error) {
+	t, err := p.getRouteTable(listener)
+	if err != nil {
+		return nil, err
+	}
+	routes, _ := t.getRoutes(r)
+	for idx := range routes {
 		// Retrieve value directly without copy
-		if p.us[idx].cond.Check(r) {
-			return p.us[idx], nil
+		if routes[idx].cond.Check(r) {
+			return routes[idx], nil
 		}
 	}
 	return nil, errors.New("No upstream matches the provided request")
@@ -89,6 +274,17 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+func headerContainsToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Copy of the same function from https://golang.org/src/net/http/httputil/reverseproxy.go
 func removeConnectionHeaders(h http.Header) {
 	for _, f := range h["Connection"] {
@@ -108,35 +304,40 @@ func removeHopByHopHeaders(h http.Header) {
 	}
 }
 
-func (p *Proxy) prepareRequest(r *http.Request) (*http.Request, error) {
-	// TODO: context timeouts/values?
-	fwd := r.Clone(r.Context())
+// serverURL returns the URL of the request sent to the server
+func (u *upstream) serverURL(s *server, reqURL *url.URL) (*url.URL, error) {
+	target := *reqURL
+	if path, ok := stripPath(reqURL.Path, u.stripPrefix); ok {
+		target.Path = path
+		// Escaped path is dropped if the prefix is written differently there
+		target.RawPath, _ = stripPath(reqURL.RawPath, u.stripPrefix)
+		if target.RawPath == reqURL.RawPath {
+			target.RawPath = ""
+		}
+	}
 
-	// TODO: consider better name
-	u, err := p.getUpstream(r)
+	// TODO: check this is the way how url should be constructed
+	result, err := url.Parse(s.URL() + target.RequestURI())
 	if err != nil {
-		return nil, errors.Wrap(err, "Can not find suitable upstream")
+		return nil, errors.Wrapf(err, "Can not parse the url %s", s.URL()+target.RequestURI())
 	}
+	return result, nil
+}
+
+func (p *Proxy) prepareRequest(u *upstream, r *http.Request) (*http.Request, *server, error) {
+	// TODO: context timeouts/values?
+	fwd := r.Clone(r.Context())
 
 	server, err := u.getServer()
 	if err != nil {
-		return nil, errors.Wrapf(err, "Can not get server for upstream %s", u.name)
+		return nil, nil, errors.Wrapf(err, "Can not get server for upstream %s", u.name)
 	}
-
-	// TODO: check this is the way how url should be constructed
-	url, err := url.Parse(server.URL() + r.URL.RequestURI())
+	url, err := u.serverURL(server, r.URL)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Can not parse the url %s", server.URL()+r.URL.RequestURI())
+		return nil, nil, err
 	}
 
 	fwd.URL = url
-
-	// Replace the value of the Host in Request
-	// Also no need to update the Host header b/c it's removed from the Request automatically
-	// ????? fwd.Host = url.Host
-	// TODO: restore the original host in request
-	// fwd.Header.Set("Host", fwd.Host)
-
 	fwd.RequestURI = ""
 
 	if _, ok := fwd.Header["User-Agent"]; !ok {
@@ -145,32 +346,41 @@ func (p *Proxy) prepareRequest(r *http.Request) (*http.Request, error) {
 	}
 
 	// TODO: allow the connection upgrade
-	if callerIP, _, err := net.SplitHostPort(fwd.RemoteAddr); err != nil {
-		if prior, ok := fwd.Header["X-Forwarded-For"]; ok {
-			callerIP = strings.Join(prior, ",") + "," + callerIP
-		}
-		// NOTE: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Forwarded
-		fwd.Header.Set("X-Forwarded-For", callerIP)
-		// TODO: Process the ipv6 correctly
-		// TODO: decide which header to use(probably both)
-		fwd.Header.Set("Forwarded", "for="+callerIP)
-	}
+	setForwardedHeaders(fwd)
+	// Host is replaced after X-Forwarded-Host has got the original one
+	fwd.Host = u.requestHost(server, r.Host)
+	setClientCertHeaders(fwd)
 
-	fwd.Header.Set("X-Forwarded-Proto", fwd.URL.Scheme)
+	// `TE: trailers` is required by gRPC and it is the only TE value that can be passed through
+	teTrailers := headerContainsToken(fwd.Header["Te"], "trailers")
 
 	removeConnectionHeaders(fwd.Header)
 	removeHopByHopHeaders(fwd.Header)
 
-	return fwd, nil
+	if teTrailers {
+		fwd.Header.Set("Te", "trailers")
+	}
+	// Request trailers are populated by the server when the body is read, so the map should be shared
+	fwd.Trailer = r.Trailer
+
+	return fwd, server, nil
 }
 
-func (p *Proxy) writeResponse(w http.ResponseWriter, resp *http.Response) error {
+// writeResponse copies the upstream response to the client
+// rw is nil when the upstream response headers are passed as is
+func (p *Proxy) writeResponse(w http.ResponseWriter, resp *http.Response, rw *responseRewriter) (int64, error) {
 	defer resp.Body.Close()
 
 	removeConnectionHeaders(resp.Header)
 	removeHopByHopHeaders(resp.Header)
 
-	// TODO: update location
+	if rw != nil {
+		rw.rewriteHeaders(resp.Header)
+	}
+	// The request ID echoed by the proxy is not duplicated by the one from the upstream
+	if rc := p.getRequestIDConfig(); rc.Echo {
+		resp.Header.Del(rc.Header)
+	}
 	for k, vv := range resp.Header {
 		// TODO: headers filtering
 		// TODO: values processing
@@ -179,104 +389,354 @@ func (p *Proxy) writeResponse(w http.ResponseWriter, resp *http.Response) error
 		}
 	}
 
+	// Trailers should be announced before the body is written
+	announced := len(resp.Trailer)
+	if announced != 0 {
+		keys := make([]string, 0, announced)
+		for k := range resp.Trailer {
+			keys = append(keys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
 	w.WriteHeader(resp.StatusCode)
 
 	// NOTE: the err might be a timeout caused by the proxyTimeout for request
-	// TODO: read and write in chunks
-	body, err := ioutil.ReadAll(resp.Body)
+	written, err := copyBody(w, resp.Body, isStreaming(resp))
 	if err != nil {
-		return errors.Wrap(err, "Can not read the upstream response")
+		return written, err
 	}
 
-	// TODO: write directly?
-	_, err = io.Copy(w, bytes.NewBuffer(body))
-	if err != nil {
-		// TODO: downstream?
-		return errors.Wrap(err, "Can not copy the response to downstream")
+	// Trailer values are known only after the whole body is read
+	for k, vv := range resp.Trailer {
+		if len(resp.Trailer) != announced {
+			// Upstream sent trailers it did not announce, see net/http.TrailerPrefix
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
 	}
+	return written, nil
+}
 
-	return nil
+// isStreaming reports whether the response parts should be sent to the downstream as soon as they are received
+func isStreaming(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	return resp.ContentLength == -1 || strings.HasPrefix(ct, "application/grpc") || strings.HasPrefix(ct, "text/event-stream")
+}
+
+// copyBody returns the number of bytes written to the downstream
+func copyBody(w http.ResponseWriter, body io.Reader, flush bool) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	flush = flush && ok
+
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				// TODO: downstream?
+				return written, errors.Wrap(err, "Can not copy the response to downstream")
+			}
+			written += int64(n)
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, errors.Wrap(rerr, "Can not read the upstream response")
+		}
+	}
+}
+
+// exchange describes the proxied request for the metrics and logs
+type exchange struct {
+	listener string
+	// route is the upstream selected by the routes, upstream differs from it on spillover
+	route        string
+	upstream     string
+	server       string
+	upstreamTime time.Duration
+	bytesOut     int64
+	// err is the reason the request failed
+	err string
 }
 
-func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) (int, error) {
-	client, err := p.getClient()
+func (p *Proxy) handle(listener string, w http.ResponseWriter, r *http.Request, ex *exchange) (int, error) {
+	// TODO: consider better name
+	u, err := p.getUpstream(listener, r)
 	if err != nil {
-		return http.StatusServiceUnavailable, errors.Wrap(err, "Error during creating request client")
+		return http.StatusServiceUnavailable, errors.Wrap(err, "Can not find suitable upstream")
 	}
+	ex.route = u.name
+	u = u.target()
+	ex.upstream = u.name
 
-	fwd, err := p.prepareRequest(r)
+	fwd, server, err := p.prepareRequest(u, r)
 	if err != nil {
 		return http.StatusServiceUnavailable, errors.Wrap(err, "Error during the proxy request preparation")
 	}
-
-	resp, err := client.Do(fwd)
+	ex.server = server.String()
+
+	cs := p.tracer.startClientSpan(fwd)
+	cs.setAttr("http.request.method", fwd.Method)
+	cs.setAttr("server.address", ex.server)
+	cs.setAttr("lb.upstream", u.name)
+
+	// Request is in flight until the response is copied to the client
+	release := server.acquire()
+	defer release()
+	start := time.Now()
+	resp, err := u.client.Do(fwd)
+	elapsed := time.Since(start)
+	if err != nil {
+		cs.fail(err.Error())
+	} else {
+		cs.setAttr("http.response.status_code", resp.StatusCode)
+	}
+	cs.finish()
+	ex.upstreamTime += elapsed
+	upstreamDuration.observe(elapsed, u.name, ex.server)
 	if err != nil {
 		return http.StatusBadGateway, errors.Wrap(err, "Error during making upstream request")
 	}
 
-	err = p.writeResponse(w, resp)
+	var rw *responseRewriter
+	if u.rewriteResponses {
+		rw = newResponseRewriter(server, fwd, u.stripPrefix)
+	}
+	ex.bytesOut, err = p.writeResponse(w, resp, rw)
 	if err != nil {
 		return http.StatusServiceUnavailable, errors.Wrap(err, "Error during writing the upstream response")
 	}
 
-	// TODO: add content length?
-	// TODO: check how logging works for proxies
-	log.Infof("[ID:%s] %s %s -> %s %d, %s, %s", GetRequestID(r.Context()), r.Method, r.URL.Path, fwd.URL, resp.StatusCode, r.RemoteAddr, r.UserAgent())
-
 	return resp.StatusCode, nil
 }
 
-// Handle is a http.HandlerFunc that serves as a root of the proxy
-// It accepts all requests and redirects them to the proxied servers
-func (p *Proxy) Handle(w http.ResponseWriter, r *http.Request) {
-	status, err := p.handle(w, r)
-	if err != nil {
-		log.Errorf("[ID:%s] %s %s : %s", GetRequestID(r.Context()), r.Method, r.URL.Path, err)
+// Handler returns http.HandlerFunc that serves as a root of the proxy for the listener
+// It accepts all requests and redirects them to the proxied servers using the listener routes
+func (p *Proxy) Handler(listener string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestsInFlight.add(1, listener)
+		defer requestsInFlight.add(-1, listener)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
 
-		if e, ok := errors.Cause(err).(net.Error); ok && e.Timeout() {
-			status = http.StatusGatewayTimeout
+		ex := getExchange(r.Context())
+		ex.listener = listener
+		status, err := p.handle(listener, w, r, ex)
+		defer func() {
+			requestsTotal.inc(listener, ex.route, ex.upstream, statusClass(status))
+			requestDuration.observe(time.Since(start), listener, ex.route)
+			requestBytes.add(float64(body.count()), listener, ex.route)
+			responseBytes.add(float64(ex.bytesOut), listener, ex.route)
+		}()
+		if err != nil {
+			ex.err = err.Error()
+			log.Errorf("[ID:%s] %s %s : %s", logRequestID(r.Context()), r.Method, r.URL.Path, err)
+
+			if e, ok := errors.Cause(err).(net.Error); ok && e.Timeout() {
+				status = http.StatusGatewayTimeout
+			}
+			// Request ID is included, so it can be quoted in the support requests
+			requestID := logRequestID(r.Context())
+			if config.IsGRPC(r) {
+				writeGRPCError(w, status, fmt.Sprintf("%s (request ID %s)", http.StatusText(status), requestID))
+				return
+			}
+			http.Error(w, fmt.Sprintf("%s\nRequest ID: %s", http.StatusText(status), requestID), status)
 		}
-		http.Error(w, http.StatusText(status), status)
 	}
-
 }
 
 func configureUpstreams(cfg *config.Config) ([]*upstream, error) {
+	timeout := time.Duration(cfg.ProxyTimeout) * time.Second
 	upstreams := make([]*upstream, 0)
 	for _, cu := range cfg.Upstreams {
 		var servers []*server
-		for _, sURL := range cu.Servers {
-			servers = append(servers, &server{scheme: sURL.Scheme, host: sURL.Hostname(), port: sURL.Port()})
+		for i, sURL := range cu.Servers {
+			s := newServer(sURL)
+			s.priority, s.weight = cu.Priorities[i], int32(cu.Weights[i])
+			servers = append(servers, s)
 		}
-		c := cu.Condition
-		cond := config.GetCondition(c.Type, c.Key, c.Value)
-		if cond == nil {
-			return nil, errors.Errorf("Can not parse condition for %s upstream", cu.Name)
+		// Upstreams without condition are used only by tcp and udp listeners
+		var cond config.Condition
+		if c := cu.Condition; c.Type != "" {
+			cond = config.GetCondition(c.Type, c.Key, c.Value)
+			if cond == nil {
+				return nil, errors.Errorf("Can not parse condition for %s upstream", cu.Name)
+			}
+		}
+
+		client, err := getClient(cu, timeout)
+		if err != nil {
+			return nil, err
 		}
 
-		upstreams = append(upstreams, &upstream{name: cu.Name, servers: servers, cond: cond})
+		upstreams = append(upstreams, &upstream{
+			name:              cu.Name,
+			servers:           servers,
+			tiers:             buildTiers(servers),
+			minHealthyPercent: cu.MinHealthyPercent,
+			cond:              cond,
+			client:            client,
+			hostHeader:        cu.HostHeader,
+			stripPrefix:       cu.StripPrefix,
+			rewriteResponses:  cu.RewriteResponses,
+			healthCheck:       cu.HealthCheck,
+			critical:          cu.Critical,
+			stop:              make(chan struct{}),
+		})
+	}
+
+	for i, cu := range cfg.Upstreams {
+		if cu.Spillover == "" {
+			continue
+		}
+		for _, u := range upstreams {
+			if u.name == cu.Spillover {
+				upstreams[i].spillover = u
+			}
+		}
 	}
 	return upstreams, nil
 }
 
+func lookupRoutes(names []string, byName map[string]*upstream) ([]*upstream, error) {
+	routes := make([]*upstream, 0, len(names))
+	for _, n := range names {
+		u, ok := byName[n]
+		if !ok {
+			return nil, errors.Errorf("Unknown upstream %s", n)
+		}
+		routes = append(routes, u)
+	}
+	return routes, nil
+}
+
+func configureRouteTables(cfg *config.Config, upstreams []*upstream) (map[string]*routeTable, error) {
+	byName := make(map[string]*upstream, len(upstreams))
+	for _, u := range upstreams {
+		byName[u.name] = u
+	}
+
+	tables := make(map[string]*routeTable, len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		routes, err := lookupRoutes(l.Routes, byName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can not configure routes for %s listener", l.Name)
+		}
+		t := &routeTable{routes: routes}
+		for _, h := range l.Hosts {
+			hr, err := lookupRoutes(h.Routes, byName)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Can not configure host routes for %s listener", l.Name)
+			}
+			t.hosts = append(t.hosts, &virtualHost{names: h.Names, routes: hr})
+		}
+		tables[l.Name] = t
+	}
+	return tables, nil
+}
+
 // Reload is method that allows to reload Proxy config without restarting the server
 func (p *Proxy) Update(cfg *config.Config) error {
+	// Server changes made while the new upstreams are built would be lost
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+
 	upstreams, err := configureUpstreams(cfg)
 	if err != nil {
 		return errors.Wrap(err, "Can not update Proxy")
 	}
+	// Changed overlay file is read again, the following server changes are saved to it
+	overlayPath, overlay := overlayFile(cfg), p.overlay
+	if overlayPath != p.overlayPath {
+		overlay, err = config.ReadOverlay(overlayPath)
+		if err != nil {
+			return errors.Wrap(err, "Can not update Proxy")
+		}
+	}
+	applyOverlay(cfg, upstreams, overlay)
+	tables, err := configureRouteTables(cfg, upstreams)
+	if err != nil {
+		return errors.Wrap(err, "Can not update Proxy")
+	}
+	p.mu.RLock()
+	for _, u := range upstreams {
+		u.inheritHealth(p.us)
+	}
+	p.mu.RUnlock()
+
 	// Update current proxy with new configuration
+	p.mu.Lock()
+	old := p.us
 	p.us = upstreams
-	p.proxyTimeout = time.Duration(cfg.ProxyTimeout) * time.Second
+	p.tables = tables
+	p.trusted = cfg.TrustedProxies
+	p.requestID = cfg.RequestID
+	p.cfg = cfg
+	p.mu.Unlock()
+	p.overlay, p.overlayPath = overlay, overlayPath
+	p.tracer.setConfig(cfg.Tracing)
+
+	for _, u := range upstreams {
+		u.startHealthChecks()
+	}
+	// Requests in flight keep using the old clients, only the idle connections are dropped
+	for _, u := range old {
+		u.stopHealthChecks()
+		u.client.CloseIdleConnections()
+	}
 	return nil
 }
 
+// overlayFile returns the path of the overlay file, it is empty when the runtime changes are not saved
+func overlayFile(cfg *config.Config) string {
+	if cfg.Admin == nil {
+		return ""
+	}
+	return cfg.Admin.Overlay
+}
+
 // NewProxy creates new Proxy struct based on the provided Config
 func NewProxy(cfg *config.Config) (*Proxy, error) {
 	upstreams, err := configureUpstreams(cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "Can not create new Proxy")
 	}
-	timeout := time.Duration(cfg.ProxyTimeout) * time.Second
-	return &Proxy{us: upstreams, proxyTimeout: timeout}, nil
+	// Server changes made with the admin API before the restart are kept in the overlay file
+	overlayPath := overlayFile(cfg)
+	overlay, err := config.ReadOverlay(overlayPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can not create new Proxy")
+	}
+	applyOverlay(cfg, upstreams, overlay)
+
+	tables, err := configureRouteTables(cfg, upstreams)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can not create new Proxy")
+	}
+	for _, u := range upstreams {
+		u.startHealthChecks()
+	}
+	return &Proxy{
+		us:          upstreams,
+		tables:      tables,
+		trusted:     cfg.TrustedProxies,
+		requestID:   cfg.RequestID,
+		cfg:         cfg,
+		overlay:     overlay,
+		overlayPath: overlayPath,
+		tracer:      newTracer(cfg.Tracing),
+	}, nil
 }
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestPrepareRequestHost(t *testing.T) {
+	socket := &upstream{name: "sidecar", stop: make(chan struct{})}
+	socket.setPool([]*server{newServer(url.URL{Scheme: "unix", Path: "/run/app.sock"})})
+
+	tests := []struct {
+		name       string
+		u          *upstream
+		hostHeader string
+		want       string
+	}{
+		{name: "preserve", u: testUpstream("api", nil, "10.0.0.1:8080"), hostHeader: config.PreserveHost, want: "www.example.com"},
+		{name: "upstream", u: testUpstream("api", nil, "10.0.0.1:8080"), hostHeader: config.UpstreamHost, want: "10.0.0.1:8080"},
+		{name: "upstream unix socket", u: socket, hostHeader: config.UpstreamHost, want: "localhost"},
+		{name: "literal", u: testUpstream("api", nil, "10.0.0.1:8080"), hostHeader: "api.internal", want: "api.internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.u.hostHeader = tt.hostHeader
+			r := httptest.NewRequest(http.MethodGet, "http://www.example.com/path", nil)
+			fwd, _, err := (&Proxy{}).prepareRequest(tt.u, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fwd.Host != tt.want {
+				t.Errorf("expected host %s, got %s", tt.want, fwd.Host)
+			}
+			if got := fwd.Header.Get("X-Forwarded-Host"); got != "www.example.com" {
+				t.Errorf("expected the client host in X-Forwarded-Host, got %s", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyV1MaxLength is the maximum length of v1 header including CRLF
+	proxyV1MaxLength = 107
+	// proxyV2MaxLength limits the addresses and TLVs of v2 header, so the client can not make us allocate 64K
+	proxyV2MaxLength = 4096
+)
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// proxyProtoListener accepts the PROXY protocol header from the trusted sources
+type proxyProtoListener struct {
+	net.Listener
+	trusted  []*net.IPNet
+	required bool
+	// timeout limits the time the trusted client can take to send the header
+	timeout time.Duration
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ip := addrIP(conn.RemoteAddr())
+	if ip == nil || !ipInNets(ip, l.trusted) {
+		return conn, nil
+	}
+	// Header is read lazily, so the slow client does not block the accept loop
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReaderSize(conn, proxyV1MaxLength), required: l.required, timeout: l.timeout}, nil
+}
+
+// proxyProtoConn reports the addresses from the PROXY header instead of the connection ones
+type proxyProtoConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+	timeout  time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+
+	// readDeadline is the one set by the server, it is restored once the header is read
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtoConn) getReadDeadline() time.Time {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	return c.readDeadline
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		// The server deadline is kept when it is earlier, e.g. ReadHeaderTimeout of the http server
+		deadline := time.Now().Add(c.timeout)
+		if d := c.getReadDeadline(); !d.IsZero() && d.Before(deadline) {
+			deadline = d
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.remote, c.local, c.err = readProxyHeader(c.reader, c.required)
+		c.Conn.SetReadDeadline(c.getReadDeadline())
+		if c.err != nil {
+			log.Errorf("Invalid PROXY protocol header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite is used by tcp proxy to pass the end of data to the client
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// detectProxyHeader returns the signature the data starts with, nil when it is not the PROXY header
+// Bytes are awaited only while they match one of the signatures, so the clients speaking first are not delayed
+func detectProxyHeader(r *bufio.Reader) ([]byte, error) {
+	for n := 1; n <= len(proxyV2Signature); n++ {
+		peek, err := r.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		v1, v2 := bytes.HasPrefix(proxyV1Prefix, peek), bytes.HasPrefix(proxyV2Signature, peek)
+		switch {
+		case v1 && n == len(proxyV1Prefix):
+			return proxyV1Prefix, nil
+		case v2 && n == len(proxyV2Signature):
+			return proxyV2Signature, nil
+		case !v1 && !v2:
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// readProxyHeader parses v1 or v2 header
+// Connections without the optional header are allowed, nil addresses are returned then
+func readProxyHeader(r *bufio.Reader, required bool) (net.Addr, net.Addr, error) {
+	signature, err := detectProxyHeader(r)
+	if err != nil {
+		// Clients of the server-first protocols send nothing until they receive the greeting
+		if !required && r.Buffered() == 0 && (err == io.EOF || isTimeout(err)) {
+			return nil, nil, nil
+		}
+		return nil, nil, errors.Wrap(err, "Can not read PROXY header")
+	}
+	switch {
+	case signature == nil && required:
+		return nil, nil, errors.New("PROXY header is required")
+	case signature == nil:
+		return nil, nil, nil
+	case bytes.Equal(signature, proxyV1Prefix):
+		return readProxyV1(r)
+	}
+	return readProxyV2(r)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Can not read PROXY v1 header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header is too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.Errorf("Malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dport, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, nil, errors.Errorf("Malformed PROXY v1 addresses %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: src, Port: int(sport)}, &net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, errors.Wrap(err, "Can not read PROXY v2 header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.Errorf("Unsupported PROXY v2 version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if length > proxyV2MaxLength {
+		return nil, nil, errors.Errorf("PROXY v2 header is too long: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, errors.Wrap(err, "Can not read PROXY v2 addresses")
+	}
+
+	// LOCAL command is used by the balancer own health checks, the real addresses should be used
+	if command == 0 {
+		return nil, nil, nil
+	}
+	if command != 1 {
+		return nil, nil, errors.Errorf("Unknown PROXY v2 command %d", command)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11, 0x12: // TCP4, UDP4
+		ipLen = net.IPv4len
+	case 0x21, 0x22: // TCP6, UDP6
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable addresses
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY v2 addresses are too short")
+	}
+	src := net.IP(payload[:ipLen])
+	dst := net.IP(payload[ipLen : 2*ipLen])
+	sport := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dport := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	// TLVs after the addresses are not used
+	return &net.TCPAddr{IP: src, Port: int(sport)}, &net.TCPAddr{IP: dst, Port: int(dport)}, nil
+}
+
+// proxyHeader builds the header passing the client addresses to the server
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	if !sok || !dok {
+		if version == 1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		// LOCAL command without addresses
+		return append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	}
+
+	s4, d4 := s.IP.To4(), d.IP.To4()
+	ipv4 := s4 != nil && d4 != nil
+	if version == 1 {
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s4, d4, s.Port, d.Port))
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port))
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	var addrs []byte
+	if ipv4 {
+		header = append(header, 0x21, 0x11)
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		header = append(header, 0x21, 0x21)
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
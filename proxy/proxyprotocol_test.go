@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds v2 header with the raw version/command and family bytes
+func proxyV2(verCmd, family byte, payload []byte) []byte {
+	header := append(append([]byte{}, proxyV2Signature...), verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func v2Addrs(src, dst net.IP, sport, dport uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	payload = binary.BigEndian.AppendUint16(payload, sport)
+	return binary.BigEndian.AppendUint16(payload, dport)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	unixPayload := make([]byte, 216)
+	copy(unixPayload, "/tmp/client.sock")
+	copy(unixPayload[108:], "/tmp/server.sock")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		required bool
+		remote   string
+		local    string
+		err      bool
+		// rest is the data left for the application
+		rest string
+	}{
+		{
+			name:   "v1 tcp4",
+			data:   []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\nGET / HTTP/1.1\r\n"),
+			remote: "192.0.2.1:51000",
+			local:  "198.51.100.2:443",
+			rest:   "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:   "v1 tcp6",
+			data:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\nhello"),
+			remote: "[2001:db8::1]:51000",
+			local:  "[2001:db8::2]:443",
+			rest:   "hello",
+		},
+		{
+			name: "v1 unknown",
+			data: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nhello"),
+			rest: "hello",
+		},
+		{
+			name: "v1 truncated",
+			data: []byte("PROXY TCP4 192.0.2.1 198.51"),
+			err:  true,
+		},
+		{
+			name: "v1 without CRLF",
+			data: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\n"),
+			err:  true,
+		},
+		{
+			name: "v1 oversized",
+			data: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"),
+			err:  true,
+		},
+		{
+			name: "v1 invalid address",
+			data: []byte("PROXY TCP4 192.0.2.300 198.51.100.2 51000 443\r\n"),
+			err:  true,
+		},
+		{
+			name: "v1 invalid port",
+			data: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 70000 443\r\n"),
+			err:  true,
+		},
+		{
+			name: "v1 unknown protocol",
+			data: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 51000 443\r\n"),
+			err:  true,
+		},
+		{
+			name:   "v2 tcp4",
+			data:   append(proxyV2(0x21, 0x11, v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 2).To4(), 51000, 443)), "hello"...),
+			remote: "192.0.2.1:51000",
+			local:  "198.51.100.2:443",
+			rest:   "hello",
+		},
+		{
+			name:   "v2 tcp6",
+			data:   append(proxyV2(0x21, 0x21, v2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 51000, 443)), "hello"...),
+			remote: "[2001:db8::1]:51000",
+			local:  "[2001:db8::2]:443",
+			rest:   "hello",
+		},
+		{
+			name:   "v2 tcp4 with TLVs",
+			data:   append(proxyV2(0x21, 0x11, append(v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 2).To4(), 1, 2), 0x04, 0x00, 0x01, 0x00)), "hello"...),
+			remote: "192.0.2.1:1",
+			local:  "198.51.100.2:2",
+			rest:   "hello",
+		},
+		{
+			name: "v2 unix",
+			data: append(proxyV2(0x21, 0x31, unixPayload), "hello"...),
+			rest: "hello",
+		},
+		{
+			name: "v2 local",
+			data: append(proxyV2(0x20, 0x00, nil), "hello"...),
+			rest: "hello",
+		},
+		{
+			name: "v2 truncated header",
+			data: proxyV2(0x21, 0x11, nil)[:14],
+			err:  true,
+		},
+		{
+			name: "v2 truncated addresses",
+			data: proxyV2(0x21, 0x11, v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 2).To4(), 1, 2))[:20],
+			err:  true,
+		},
+		{
+			name: "v2 addresses shorter than family",
+			data: proxyV2(0x21, 0x21, make([]byte, 12)),
+			err:  true,
+		},
+		{
+			name: "v2 oversized",
+			data: append(append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0xff, 0xff), make([]byte, 1024)...),
+			err:  true,
+		},
+		{
+			name: "v2 unsupported version",
+			data: proxyV2(0x11, 0x11, v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 2).To4(), 1, 2)),
+			err:  true,
+		},
+		{
+			name: "v2 unknown command",
+			data: proxyV2(0x22, 0x11, v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 2).To4(), 1, 2)),
+			err:  true,
+		},
+		{
+			name: "no header",
+			data: []byte("GET / HTTP/1.1\r\n"),
+			rest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name: "short client message",
+			data: []byte("PING"),
+			rest: "PING",
+		},
+		{
+			name: "empty connection",
+			data: []byte{},
+		},
+		{
+			name:     "no header when required",
+			data:     []byte("GET / HTTP/1.1\r\n"),
+			required: true,
+			err:      true,
+		},
+		{
+			name:     "empty connection when required",
+			data:     []byte{},
+			required: true,
+			err:      true,
+		},
+		{
+			name:     "header when required",
+			data:     []byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\n"),
+			required: true,
+			remote:   "192.0.2.1:51000",
+			local:    "198.51.100.2:443",
+		},
+		{
+			name: "partial signature",
+			data: []byte("PROX"),
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(tt.data), proxyV1MaxLength)
+			remote, local, err := readProxyHeader(r, tt.required)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v %v", remote, local)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := addrString(remote); got != tt.remote {
+				t.Errorf("expected remote %q, got %q", tt.remote, got)
+			}
+			if got := addrString(local); got != tt.local {
+				t.Errorf("expected local %q, got %q", tt.local, got)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != tt.rest {
+				t.Errorf("expected %q left for the application, got %q", tt.rest, rest)
+			}
+		})
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+	}{
+		{"tcp4", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51000}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 443}},
+		{"tcp6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{"unix", &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/tmp/b.sock", Net: "unix"}},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{1, 2} {
+			header := proxyHeader(version, tt.src, tt.dst)
+			remote, local, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)), true)
+			if err != nil {
+				t.Fatalf("%s v%d: unexpected error: %s", tt.name, version, err)
+			}
+			want := [2]string{tt.src.String(), tt.dst.String()}
+			if _, ok := tt.src.(*net.TCPAddr); !ok {
+				want = [2]string{}
+			}
+			if got := [2]string{addrString(remote), addrString(local)}; got != want {
+				t.Errorf("%s v%d: expected %v, got %v", tt.name, version, want, got)
+			}
+		}
+	}
+}
+
+// deadlineConn records the read deadlines set on the connection
+type deadlineConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestProxyProtoConnKeepsServerDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &deadlineConn{Conn: server}
+	pc := &proxyProtoConn{Conn: conn, reader: bufio.NewReaderSize(conn, proxyV1MaxLength), timeout: 5 * time.Second}
+
+	serverDeadline := time.Now().Add(time.Minute)
+	pc.SetReadDeadline(serverDeadline)
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 51000 443\r\nhello"))
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(pc, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := pc.RemoteAddr().String(); got != "192.0.2.1:51000" {
+		t.Errorf("expected remote address from the header, got %s", got)
+	}
+	if last := conn.deadlines[len(conn.deadlines)-1]; !last.Equal(serverDeadline) {
+		t.Errorf("expected server deadline %s to be restored, got %s", serverDeadline, last)
+	}
+}
+
+func TestProxyProtoConnOptionalHeaderTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	pc := &proxyProtoConn{Conn: server, reader: bufio.NewReaderSize(server, proxyV1MaxLength), timeout: 5 * time.Second}
+
+	// Server-first protocol, the client waits for the greeting and sends nothing
+	pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if remote := pc.RemoteAddr(); remote.String() != server.RemoteAddr().String() {
+		t.Errorf("expected connection address, got %s", remote)
+	}
+	if pc.err != nil {
+		t.Fatalf("connection without optional header should be kept, got %s", pc.err)
+	}
+	pc.SetReadDeadline(time.Time{})
+	go client.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(pc, b); err != nil || string(b) != "hello" {
+		t.Fatalf("expected client data, got %q %v", b, err)
+	}
+}
+
+func TestProxyProtoListenerHeaderTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &proxyProtoListener{Listener: inner, trusted: mustCIDRs(t, "127.0.0.0/8"), timeout: 100 * time.Millisecond}
+	defer ln.Close()
+
+	// Server-first protocol greets the client once its address is known
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(addrString(conn.RemoteAddr())))
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	start := time.Now()
+	client.SetReadDeadline(start.Add(2 * time.Second))
+	greeting, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("trusted client without header should be served after the timeout: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the greeting after the header timeout, got it in %s", elapsed)
+	}
+	if string(greeting) != client.LocalAddr().String() {
+		t.Errorf("expected connection address %s, got %q", client.LocalAddr(), greeting)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+type upstreamReadiness struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Ready    bool   `json:"ready"`
+	// Available is the number of the healthy active servers, Servers is the total number of servers
+	// Draining and disabled servers are never available, even when they are healthy
+	Available int `json:"available"`
+	Draining  int `json:"draining"`
+	Disabled  int `json:"disabled"`
+	Servers   int `json:"servers"`
+	// Spillover is set when the upstream is served by its spillover upstream
+	Spillover string `json:"spillover,omitempty"`
+}
+
+type readiness struct {
+	Ready bool `json:"ready"`
+	// ShuttingDown is set while the listeners are drained before exit
+	ShuttingDown bool                `json:"shuttingDown"`
+	Reloading    bool                `json:"reloading"`
+	Errors       []string            `json:"errors,omitempty"`
+	Upstreams    []upstreamReadiness `json:"upstreams"`
+}
+
+// availableServers returns the number of the healthy active servers that can receive the requests
+func (u *upstream) availableServers() int {
+	servers, _ := u.pool()
+	available := 0
+	for _, s := range servers {
+		if s.isHealthy() && s.getState() == activeState {
+			available++
+		}
+	}
+	return available
+}
+
+func newUpstreamReadiness(u *upstream) upstreamReadiness {
+	r := upstreamReadiness{Name: u.name, Critical: u.critical, Available: u.availableServers()}
+	servers, _ := u.pool()
+	r.Servers = len(servers)
+	for _, s := range servers {
+		switch s.getState() {
+		case drainingState:
+			r.Draining++
+		case disabledState:
+			r.Disabled++
+		}
+	}
+	r.Ready = r.Available > 0
+	// Requests are still served when the spillover upstream takes over
+	if !r.Ready && u.spillover != nil && u.spillover.availableServers() > 0 {
+		r.Ready, r.Spillover = true, u.spillover.name
+	}
+	return r
+}
+
+// readyHandler reports whether the balancer can serve the traffic
+// It fails during the shutdown and the reloads and when any of the critical upstreams has no healthy servers
+func (p *ProxyServer) readyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := readiness{
+			ShuttingDown: atomic.LoadInt32(&p.health) != 1,
+			Reloading:    atomic.LoadInt32(&p.reloading) > 0,
+			Upstreams:    []upstreamReadiness{},
+		}
+		if res.ShuttingDown {
+			res.Errors = append(res.Errors, "Server is starting up or shutting down")
+		}
+		if res.Reloading {
+			res.Errors = append(res.Errors, "Config reload is in progress")
+		}
+
+		p.proxy.mu.RLock()
+		us := p.proxy.us
+		p.proxy.mu.RUnlock()
+		for _, u := range us {
+			ur := newUpstreamReadiness(u)
+			if ur.Critical && !ur.Ready {
+				res.Errors = append(res.Errors, fmt.Sprintf("Critical upstream %s has no healthy active servers", u.name))
+			}
+			res.Upstreams = append(res.Upstreams, ur)
+		}
+
+		res.Ready = len(res.Errors) == 0
+		status := http.StatusOK
+		if !res.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, res)
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	setStates := func(u *upstream, states ...int32) *upstream {
+		servers, _ := u.pool()
+		for i, st := range states {
+			servers[i].state = st
+		}
+		return u
+	}
+	unhealthy := func(u *upstream) *upstream {
+		servers, _ := u.pool()
+		for _, s := range servers {
+			s.setHealthy(false)
+		}
+		return u
+	}
+	critical := func(u *upstream) *upstream {
+		u.critical = true
+		return u
+	}
+
+	tests := []struct {
+		name      string
+		upstreams func() []*upstream
+		shutdown  bool
+		reloading bool
+		status    int
+	}{
+		{
+			name: "healthy critical upstream",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(testUpstream("api", nil, "10.0.0.1:80"))}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "unhealthy upstream is not critical",
+			upstreams: func() []*upstream {
+				return []*upstream{unhealthy(testUpstream("api", nil, "10.0.0.1:80"))}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "unhealthy critical upstream",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(unhealthy(testUpstream("api", nil, "10.0.0.1:80")))}
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "all servers of critical upstream are draining or disabled",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(setStates(testUpstream("api", nil, "10.0.0.1:80", "10.0.0.2:80"), drainingState, disabledState))}
+			},
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name: "one active server is enough",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(setStates(testUpstream("api", nil, "10.0.0.1:80", "10.0.0.2:80"), drainingState, activeState))}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "spillover serves critical upstream",
+			upstreams: func() []*upstream {
+				u := critical(unhealthy(testUpstream("api", nil, "10.0.0.1:80")))
+				u.spillover = testUpstream("backup", nil, "10.0.1.1:80")
+				return []*upstream{u, u.spillover}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "shutting down",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(testUpstream("api", nil, "10.0.0.1:80"))}
+			},
+			shutdown: true,
+			status:   http.StatusServiceUnavailable,
+		},
+		{
+			name: "reloading",
+			upstreams: func() []*upstream {
+				return []*upstream{critical(testUpstream("api", nil, "10.0.0.1:80"))}
+			},
+			reloading: true,
+			status:    http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := &ProxyServer{proxy: &Proxy{us: tt.upstreams()}}
+			ps.setServerHealth(!tt.shutdown)
+			if tt.reloading {
+				ps.reloading = 1
+			}
+
+			w := httptest.NewRecorder()
+			ps.readyHandler()(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+			var res readiness
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Ready != (tt.status == http.StatusOK) || res.ShuttingDown != tt.shutdown || res.Reloading != tt.reloading {
+				t.Errorf("unexpected readiness %+v", res)
+			}
+			if !res.Ready && len(res.Errors) == 0 {
+				t.Errorf("not ready response should explain the reason")
+			}
+
+			health := httptest.NewRecorder()
+			ps.healthHandler()(health, httptest.NewRequest(http.MethodGet, "/-/health", nil))
+			if health.Code != http.StatusOK {
+				t.Errorf("liveness should not depend on the readiness, got %d", health.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+// Headers describing the original request that are accepted only from the trusted proxies
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"Forwarded",
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// parseForwardedIP accepts the X-Forwarded-For entries with optional port and brackets
+func parseForwardedIP(v string) net.IP {
+	v = strings.TrimSpace(v)
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		v = host
+	}
+	return net.ParseIP(strings.Trim(v, "[]"))
+}
+
+// splitQuoted splits the header value by sep outside of the quoted strings
+func splitQuoted(v string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			parts = append(parts, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, v[start:])
+}
+
+func unquoteForwarded(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// forwardedFor returns the for= nodes of the Forwarded elements in order
+// Elements without for= are empty, so they stop the walk like the obfuscated identifiers
+func forwardedFor(values []string) []string {
+	var nodes []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = unquoteForwarded(kv[1])
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// resolveClientIP returns the client IP and whether the connection peer is the trusted proxy
+// X-Forwarded-For, or Forwarded when it is missing, is read from right to left,
+// the first address that is not trusted is the client one
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) (net.IP, bool) {
+	peer := remoteIP(r)
+	if peer == nil || !ipInNets(peer, trusted) {
+		return peer, false
+	}
+
+	var entries []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	if len(entries) == 0 {
+		entries = forwardedFor(r.Header["Forwarded"])
+	}
+
+	client := peer
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(entries[i])
+		if ip == nil {
+			// Garbage and obfuscated identifiers can not be trusted, so stop at the last known address
+			break
+		}
+		client = ip
+		if !ipInNets(ip, trusted) {
+			break
+		}
+	}
+	return client, true
+}
+
+// realIP returns Middleware that resolves the client IP for the conditions, logs and forwarded headers
+func realIP(p *Proxy) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, fromProxy := resolveClientIP(r, p.getTrustedProxies())
+			ctx := config.ContextWithClientIP(r.Context(), ip)
+			ctx = context.WithValue(ctx, trustedPeerKey, fromProxy)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientAddr is the client address used in logs
+func clientAddr(r *http.Request) string {
+	if ip := config.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+func isForwardedTokenChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// quoteForwarded returns the value as token or quoted-string as required by RFC 7239
+func quoteForwarded(v string) string {
+	for i := 0; i < len(v); i++ {
+		if !isForwardedTokenChar(v[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// forwardedNode formats the node identifier, IPv6 addresses should be enclosed in brackets and quoted
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return quoteForwarded("[" + ip.String() + "]")
+	}
+	return ip.String()
+}
+
+func requestProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// setForwardedHeaders adds the balancer hop to X-Forwarded-* and Forwarded headers
+// Values received from the untrusted peers are dropped, so the upstream can rely on them
+func setForwardedHeaders(fwd *http.Request) {
+	if fromProxy, _ := fwd.Context().Value(trustedPeerKey).(bool); !fromProxy {
+		for _, h := range forwardedHeaders {
+			fwd.Header.Del(h)
+		}
+	}
+
+	peer := remoteIP(fwd)
+	proto := requestProto(fwd)
+
+	// NOTE: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For
+	if peer != nil {
+		xff := peer.String()
+		if prior, ok := fwd.Header["X-Forwarded-For"]; ok {
+			xff = strings.Join(prior, ", ") + ", " + xff
+		}
+		fwd.Header.Set("X-Forwarded-For", xff)
+	}
+	// Host and proto set by the trusted proxy describe the original request better than ours
+	if fwd.Header.Get("X-Forwarded-Host") == "" {
+		fwd.Header.Set("X-Forwarded-Host", fwd.Host)
+	}
+	if fwd.Header.Get("X-Forwarded-Proto") == "" {
+		fwd.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	// NOTE: https://tools.ietf.org/html/rfc7239
+	element := []string{"for=" + forwardedNode(peer)}
+	if local, ok := fwd.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if ip := addrIP(local); ip != nil {
+			element = append(element, "by="+forwardedNode(ip))
+		}
+	}
+	if fwd.Host != "" {
+		element = append(element, "host="+quoteForwarded(fwd.Host))
+	}
+	element = append(element, "proto="+proto)
+
+	forwarded := strings.Join(element, ";")
+	if prior, ok := fwd.Header["Forwarded"]; ok {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+	fwd.Header.Set("Forwarded", forwarded)
+}
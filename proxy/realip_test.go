@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := mustCIDRs(t, "10.0.0.0/8", "2001:db8:ffff::/48")
+
+	tests := []struct {
+		name      string
+		peer      string
+		xff       []string
+		forwarded []string
+		client    string
+		fromProxy bool
+	}{
+		{
+			name:   "untrusted peer headers are ignored",
+			peer:   "203.0.113.7:4000",
+			xff:    []string{"198.51.100.1"},
+			client: "203.0.113.7",
+		},
+		{
+			name:      "trusted peer without headers",
+			peer:      "10.0.0.1:4000",
+			client:    "10.0.0.1",
+			fromProxy: true,
+		},
+		{
+			name:      "rightmost untrusted entry is the client",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "spoofed leftmost entries are skipped",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"10.0.0.9, 127.0.0.1, 203.0.113.7"},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "entries from several header lines",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"198.51.100.1", "203.0.113.7", "10.0.0.2"},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "all trusted chain uses the leftmost entry",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"10.0.0.3, 10.0.0.2"},
+			client:    "10.0.0.3",
+			fromProxy: true,
+		},
+		{
+			name:      "garbage stops at the last known address",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"203.0.113.7, not-an-ip, 10.0.0.2"},
+			client:    "10.0.0.2",
+			fromProxy: true,
+		},
+		{
+			name:      "ipv4 with port",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"203.0.113.7:51000"},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "ipv6 with brackets and port",
+			peer:      "[2001:db8:ffff::1]:4000",
+			xff:       []string{"[2001:db8::17]:4711, 2001:db8:ffff::2"},
+			client:    "2001:db8::17",
+			fromProxy: true,
+		},
+		{
+			name:      "ipv6 with brackets without port",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{" [2001:db8::17] "},
+			client:    "2001:db8::17",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded is used without x-forwarded-for",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`for=198.51.100.1;proto=https, for=203.0.113.7;by=10.0.0.2, for=10.0.0.2`},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded quoted ipv6 with port",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`for="[2001:db8:cafe::17]:4711"`},
+			client:    "2001:db8:cafe::17",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded parameters in any case and order",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`proto=http;FOR="203.0.113.7";host="a.example.com,b"`},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded obfuscated identifier stops the walk",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`for=203.0.113.7, for=_hidden, for=10.0.0.2`},
+			client:    "10.0.0.2",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded unknown identifier stops the walk",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`for=203.0.113.7, for=unknown`},
+			client:    "10.0.0.1",
+			fromProxy: true,
+		},
+		{
+			name:      "forwarded element without for stops the walk",
+			peer:      "10.0.0.1:4000",
+			forwarded: []string{`for=203.0.113.7, proto=https`},
+			client:    "10.0.0.1",
+			fromProxy: true,
+		},
+		{
+			name:      "x-forwarded-for is preferred over forwarded",
+			peer:      "10.0.0.1:4000",
+			xff:       []string{"203.0.113.7"},
+			forwarded: []string{"for=198.51.100.1"},
+			client:    "203.0.113.7",
+			fromProxy: true,
+		},
+		{
+			name:   "peer without port",
+			peer:   "10.0.0.1",
+			xff:    []string{"203.0.113.7"},
+			client: "<nil>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			r.Header["X-Forwarded-For"] = tt.xff
+			r.Header["Forwarded"] = tt.forwarded
+			ip, fromProxy := resolveClientIP(r, trusted)
+			if ip.String() != tt.client || fromProxy != tt.fromProxy {
+				t.Errorf("expected %s from proxy %v, got %s %v", tt.client, tt.fromProxy, ip, fromProxy)
+			}
+		})
+	}
+}
+
+func TestQuoteForwarded(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"example.com", "example.com"},
+		{"example.com:8080", `"example.com:8080"`},
+		{"[2001:db8::1]", `"[2001:db8::1]"`},
+		{`a"b`, `"a\"b"`},
+		{`a\b`, `"a\\b"`},
+		{"a b", `"a b"`},
+	}
+	for _, tt := range tests {
+		if got := quoteForwarded(tt.value); got != tt.want {
+			t.Errorf("quoteForwarded(%q): expected %s, got %s", tt.value, tt.want, got)
+		}
+		if got := unquoteForwarded(quoteForwarded(tt.value)); got != tt.value {
+			t.Errorf("unquoteForwarded(%s): expected %q, got %q", quoteForwarded(tt.value), tt.value, got)
+		}
+	}
+}
+
+func TestForwardedNode(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{nil, "unknown"},
+		{net.ParseIP("192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("::ffff:192.0.2.1"), "192.0.2.1"},
+		{net.ParseIP("2001:db8::1"), `"[2001:db8::1]"`},
+	}
+	for _, tt := range tests {
+		if got := forwardedNode(tt.ip); got != tt.want {
+			t.Errorf("forwardedNode(%s): expected %s, got %s", tt.ip, tt.want, got)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		peer      string
+		fromProxy bool
+		tls       bool
+		headers   map[string]string
+		want      map[string]string
+	}{
+		{
+			name: "client headers are dropped",
+			peer: "203.0.113.7:4000",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.1.1.1",
+				"X-Forwarded-Host":  "evil.example.com",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.1.1.1",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Host":  "a.example.com",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=203.0.113.7;by=192.0.2.10;host=a.example.com;proto=http",
+			},
+		},
+		{
+			name:      "trusted proxy headers are appended",
+			peer:      "10.0.0.1:4000",
+			fromProxy: true,
+			tls:       true,
+			headers: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Host":  "www.example.com",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=203.0.113.7;proto=https",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.0.0.1",
+				"X-Forwarded-Host":  "www.example.com",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=203.0.113.7;proto=https, for=10.0.0.1;by=192.0.2.10;host=a.example.com;proto=https",
+			},
+		},
+		{
+			name: "ipv6 peer is quoted",
+			peer: "[2001:db8::17]:4711",
+			tls:  true,
+			want: map[string]string{
+				"X-Forwarded-For":   "2001:db8::17",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         `for="[2001:db8::17]";by=192.0.2.10;host=a.example.com;proto=https`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "http://a.example.com/"
+			if tt.tls {
+				target = "https://a.example.com/"
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			ctx := context.WithValue(r.Context(), trustedPeerKey, tt.fromProxy)
+			ctx = context.WithValue(ctx, http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 443})
+			r = r.WithContext(ctx)
+
+			setForwardedHeaders(r)
+			for k, v := range tt.want {
+				if got := r.Header.Get(k); got != v {
+					t.Errorf("%s: expected %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func isRedirectException(path string, exceptions []string) bool {
+	for _, e := range exceptions {
+		if path == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(path, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpsRedirect sends all requests to the same host, path and query over https
+// Requests for the exception paths are passed to the next handler
+func httpsRedirect(cfg *config.Redirect, httpsAddress string, next http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRedirectException(r.URL.Path, cfg.Exceptions) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// Bare IPv6 address should be enclosed in brackets
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, cfg.Status)
+	})
+}
+
+func hstsValue(cfg *config.HSTS) string {
+	v := "max-age=" + strconv.Itoa(cfg.MaxAge)
+	if cfg.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if cfg.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// hsts returns Middleware that sets Strict-Transport-Security header for the requests received over TLS
+func hsts(cfg *config.HSTS) Middleware {
+	value := hstsValue(cfg)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The header is ignored by browsers when received over plain HTTP
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	cfg := &config.Redirect{Status: http.StatusPermanentRedirect, Exceptions: []string{"/-/health", "/.well-known/acme-challenge/"}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name     string
+		https    string
+		target   string
+		host     string
+		status   int
+		location string
+	}{
+		{name: "path and query", https: ":443", target: "/a/b?c=d", host: "example.com", status: http.StatusPermanentRedirect, location: "https://example.com/a/b?c=d"},
+		{name: "request port is replaced", https: ":443", target: "/", host: "example.com:8080", status: http.StatusPermanentRedirect, location: "https://example.com/"},
+		{name: "non default https port", https: ":8443", target: "/", host: "example.com", status: http.StatusPermanentRedirect, location: "https://example.com:8443/"},
+		{name: "ipv6 host", https: ":443", target: "/", host: "[2001:db8::1]:80", status: http.StatusPermanentRedirect, location: "https://[2001:db8::1]/"},
+		{name: "exact exception", https: ":443", target: "/-/health", host: "example.com", status: http.StatusTeapot},
+		{name: "exception is not a prefix", https: ":443", target: "/-/healthz", host: "example.com", status: http.StatusPermanentRedirect, location: "https://example.com/-/healthz"},
+		{name: "nested exception", https: ":443", target: "/.well-known/acme-challenge/token", host: "example.com", status: http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			httpsRedirect(cfg, tt.https, next).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, w.Code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("expected location %q, got %q", tt.location, got)
+			}
+		})
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	handler := hsts(&config.HSTS{MaxAge: 31536000, IncludeSubDomains: true, Preload: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name string
+		tls  bool
+		want string
+	}{
+		{name: "tls request", tls: true, want: "max-age=31536000; includeSubDomains; preload"},
+		{name: "plain request", tls: false, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// stripPath removes the prefix from the request path, the prefix should match the whole path segments
+func stripPath(path, prefix string) (string, bool) {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path, false
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/", true
+	}
+	if rest[0] != '/' {
+		return path, false
+	}
+	return rest, true
+}
+
+// responseRewriter maps the server addresses in the response headers to the ones used by the client
+type responseRewriter struct {
+	// hosts are the host:port values the server may use to refer to itself
+	hosts  []string
+	scheme string
+	host   string
+	prefix string
+}
+
+// newResponseRewriter uses the public scheme and host from the forwarded headers,
+// so the addresses set by the trusted proxy in front of the balancer are restored too
+func newResponseRewriter(s *server, fwd *http.Request, prefix string) *responseRewriter {
+	rw := &responseRewriter{
+		scheme: fwd.Header.Get("X-Forwarded-Proto"),
+		host:   fwd.Header.Get("X-Forwarded-Host"),
+		prefix: prefix,
+	}
+	if rw.scheme == "" {
+		rw.scheme = requestProto(fwd)
+	}
+	if rw.host == "" {
+		rw.host = fwd.Host
+	}
+	// Host header sent to the server uses the server scheme, so its default port is the server one
+	rw.hosts = []string{s.address(), withDefaultPort(fwd.Host, s.scheme), withDefaultPort(rw.host, rw.scheme)}
+	return rw
+}
+
+// withDefaultPort adds the default port of the scheme to the host without port
+func withDefaultPort(host, scheme string) string {
+	if host == "" {
+		return host
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if scheme == "https" || scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// isServerHost reports whether the URL host refers to the server, the default ports are explicit when compared
+func (rw *responseRewriter) isServerHost(host, scheme string) bool {
+	host = withDefaultPort(host, scheme)
+	for _, h := range rw.hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (rw *responseRewriter) isServerDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	for _, h := range rw.hosts {
+		if strings.EqualFold(hostname(h), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteURL returns the public URL for the absolute URL pointing to the server or the path-absolute reference
+// Other URLs and the relative references are returned as is
+func (rw *responseRewriter) rewriteURL(v string) string {
+	loc, err := url.Parse(v)
+	if err != nil {
+		return v
+	}
+	if loc.IsAbs() || loc.Host != "" {
+		// Scheme relative reference uses the scheme of the response
+		scheme := loc.Scheme
+		if scheme == "" {
+			scheme = rw.scheme
+		}
+		if !rw.isServerHost(loc.Host, scheme) {
+			return v
+		}
+		if loc.Scheme != "" {
+			loc.Scheme = rw.scheme
+		}
+		loc.Host = rw.host
+	} else if !strings.HasPrefix(loc.Path, "/") {
+		return v
+	}
+
+	if rw.prefix != "" {
+		loc.Path = rw.prefix + loc.Path
+		if loc.RawPath != "" {
+			loc.RawPath = rw.prefix + loc.RawPath
+		}
+	}
+	return loc.String()
+}
+
+// rewriteCookie updates Domain and Path attributes of the Set-Cookie value
+// Attributes are edited in place to keep the ones that net/http does not know about
+func (rw *responseRewriter) rewriteCookie(v string) string {
+	parts := strings.Split(v, ";")
+	// The first part is the cookie name and value
+	for i := 1; i < len(parts); i++ {
+		attr := strings.TrimSpace(parts[i])
+		eq := strings.IndexByte(attr, '=')
+		if eq < 0 {
+			continue
+		}
+		name, value := attr[:eq], strings.TrimSpace(attr[eq+1:])
+		switch strings.ToLower(name) {
+		case "domain":
+			if rw.isServerDomain(value) {
+				parts[i] = " " + name + "=" + hostname(rw.host)
+			}
+		case "path":
+			if rw.prefix != "" && strings.HasPrefix(value, "/") {
+				parts[i] = " " + name + "=" + strings.TrimSuffix(rw.prefix+value, "/")
+			}
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func (rw *responseRewriter) rewriteHeaders(h http.Header) {
+	for _, k := range []string{"Location", "Content-Location"} {
+		if v := h.Get(k); v != "" {
+			h.Set(k, rw.rewriteURL(v))
+		}
+	}
+	for i, v := range h["Set-Cookie"] {
+		h["Set-Cookie"][i] = rw.rewriteCookie(v)
+	}
+}
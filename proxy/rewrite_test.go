@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testRewriter(serverURL, prefix string, headers map[string]string) *responseRewriter {
+	u, _ := url.Parse(serverURL)
+	fwd := httptest.NewRequest(http.MethodGet, serverURL+"/", nil)
+	for k, v := range headers {
+		fwd.Header.Set(k, v)
+	}
+	return newResponseRewriter(newServer(*u), fwd, prefix)
+}
+
+func TestRewriteURL(t *testing.T) {
+	public := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "www.example.com"}
+	tests := []struct {
+		name   string
+		server string
+		prefix string
+		value  string
+		want   string
+	}{
+		{name: "server address", server: "http://10.0.0.1:3000", value: "http://10.0.0.1:3000/login?next=/", want: "https://www.example.com/login?next=/"},
+		{name: "default http port is omitted", server: "http://10.0.0.1:80", value: "http://10.0.0.1/x", want: "https://www.example.com/x"},
+		{name: "default https port is omitted", server: "https://10.0.0.1:443", value: "https://10.0.0.1/x", want: "https://www.example.com/x"},
+		{name: "default port of the other scheme", server: "http://10.0.0.1:80", value: "https://10.0.0.1/x", want: "https://10.0.0.1/x"},
+		{name: "explicit default port", server: "http://10.0.0.1:80", value: "http://10.0.0.1:80/x", want: "https://www.example.com/x"},
+		{name: "public host with explicit port", server: "http://10.0.0.1:3000", value: "https://www.example.com:443/x", want: "https://www.example.com/x"},
+		{name: "other host", server: "http://10.0.0.1:3000", value: "http://10.0.0.2:3000/x", want: "http://10.0.0.2:3000/x"},
+		{name: "path absolute reference gets the prefix", server: "http://10.0.0.1:3000", prefix: "/app", value: "/login", want: "/app/login"},
+		{name: "relative reference", server: "http://10.0.0.1:3000", prefix: "/app", value: "login", want: "login"},
+		{name: "server address gets the prefix", server: "http://10.0.0.1:3000", prefix: "/app", value: "http://10.0.0.1:3000/", want: "https://www.example.com/app/"},
+		{name: "ipv6 server without port", server: "http://[2001:db8::1]:80", value: "http://[2001:db8::1]/x", want: "https://www.example.com/x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := testRewriter(tt.server, tt.prefix, public)
+			if got := rw.rewriteURL(tt.value); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRewriteCookie(t *testing.T) {
+	public := map[string]string{"X-Forwarded-Host": "www.example.com"}
+	tests := []struct {
+		name   string
+		prefix string
+		value  string
+		want   string
+	}{
+		{name: "server domain", value: "id=1; Domain=10.0.0.1; HttpOnly", want: "id=1; Domain=www.example.com; HttpOnly"},
+		{name: "other domain", value: "id=1; Domain=example.org", want: "id=1; Domain=example.org"},
+		{name: "path gets the prefix", prefix: "/app", value: "id=1; Path=/; Secure", want: "id=1; Path=/app; Secure"},
+		{name: "nested path gets the prefix", prefix: "/app", value: "id=1; path=/admin", want: "id=1; path=/app/admin"},
+		{name: "path without prefix", value: "id=1; Path=/admin", want: "id=1; Path=/admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := testRewriter("http://10.0.0.1:3000", tt.prefix, public)
+			if got := rw.rewriteCookie(tt.value); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStripPath(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         string
+		ok           bool
+	}{
+		{"/app/x", "/app", "/x", true},
+		{"/app", "/app", "/", true},
+		{"/application", "/app", "/application", false},
+		{"/other", "/app", "/other", false},
+		{"/x", "", "/x", false},
+	}
+	for _, tt := range tests {
+		if got, ok := stripPath(tt.path, tt.prefix); got != tt.want || ok != tt.ok {
+			t.Errorf("stripPath(%s, %s): expected %s %v, got %s %v", tt.path, tt.prefix, tt.want, tt.ok, got, ok)
+		}
+	}
+}
@@ -2,26 +2,109 @@ package proxy
 
 import (
 	"context"
-	"fmt"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-type ProxyServer struct {
+// listener is a single bound address served by the ProxyServer
+type listener struct {
+	cfg    config.Listener
 	server *http.Server
 	router *http.ServeMux
-	proxy  *Proxy
-	// healthy is the marker of the server status
+	// certs is set only for https listeners
+	certs *certStore
+	// tcp and udp are set only for the listeners of the same protocol, server and router are not used then
+	tcp *tcpProxy
+	udp *udpProxy
+
+	// ln or pc (for udp) is set when the address is bound
+	ln net.Listener
+	pc net.PacketConn
+}
+
+func (l *listener) bind() error {
+	if l.udp != nil {
+		pc, err := net.ListenPacket(l.cfg.Network, l.cfg.Address)
+		if err != nil {
+			return errors.Wrapf(err, "Can not listen on %s", l.cfg.Address)
+		}
+		l.pc = pc
+		return nil
+	}
+
+	if l.cfg.Network == "unix" {
+		// Remove the socket left by the previous run, otherwise bind fails
+		if fi, err := os.Stat(l.cfg.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(l.cfg.Address); err != nil {
+				return errors.Wrapf(err, "Can not remove stale socket %s", l.cfg.Address)
+			}
+		}
+	}
+	ln, err := net.Listen(l.cfg.Network, l.cfg.Address)
+	if err != nil {
+		return errors.Wrapf(err, "Can not listen on %s", l.cfg.Address)
+	}
+	if l.cfg.ProxyProtocol != nil {
+		// Wrapped below TLS, so the header is read before the handshake
+		pp := l.cfg.ProxyProtocol
+		ln = &proxyProtoListener{Listener: ln, trusted: pp.Trusted, required: pp.Required, timeout: pp.Timeout}
+	}
+	l.ln = ln
+	return nil
+}
+
+func (l *listener) serve() error {
+	switch {
+	case l.udp != nil:
+		return l.udp.serve(l.pc)
+	case l.tcp != nil:
+		return l.tcp.serve(l.ln)
+	case l.certs != nil:
+		// Certificates are provided by the TLSConfig.GetCertificate
+		return l.server.ServeTLS(l.ln, "", "")
+	}
+	return l.server.Serve(l.ln)
+}
+
+func (l *listener) shutdown(ctx context.Context) error {
+	if l.udp != nil {
+		return l.udp.shutdown(ctx)
+	}
+	if l.tcp != nil {
+		return l.tcp.shutdown(ctx)
+	}
+	// Disable ongoing keep-alive connections
+	l.server.SetKeepAlivesEnabled(false)
+	return l.server.Shutdown(ctx)
+}
+
+type ProxyServer struct {
+	listeners []*listener
+	proxy     *Proxy
+	accessLog *accessLogger
+	reloads   *reloadHistory
+	admin     *adminGuard
+	// health is the marker of the server status used by the readiness
 	// 0 means server is starting up or shutting down
 	// 1 means server is up and running
 	health int32
+	// reloading is the number of the reloads in progress
+	reloading int32
+	// started is the config the listeners were created from
+	started *config.Config
 
 	done chan bool
 }
@@ -34,32 +117,48 @@ func (p *ProxyServer) setServerHealth(h bool) {
 	atomic.StoreInt32(&(p.health), v)
 }
 
+// healthHandler reports only the liveness of the process, so it succeeds during the shutdown too
+// Shutdown, reloads and the upstreams are reported by readyHandler
 func (p *ProxyServer) healthHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if atomic.LoadInt32(&(p.health)) == 1 {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		w.WriteHeader(http.StatusServiceUnavailable)
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
-// TODO: Authentication
 func (p *ProxyServer) reloadHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// TODO: read config path from request
 		// TODO: reload server config (not only proxy)
 		// TODO: maybe create new proxy instead of updating existing - possible memory leak?
 		configPath := "config.yml"
+		start := time.Now()
+		atomic.AddInt32(&p.reloading, 1)
+		defer atomic.AddInt32(&p.reloading, -1)
 		cfg, err := config.ReadConfig(configPath)
+		if err == nil {
+			err = config.CheckListenerChanges(p.started.Listeners, cfg.Listeners)
+		}
+		if err == nil {
+			err = config.CheckAdminChanges(p.started.Admin, cfg.Admin)
+		}
 		if err != nil {
+			recordReload(err)
+			p.reloads.add(start, err)
 			log.Error(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		config.SetupLogging(cfg)
-		err = p.proxy.Update(cfg)
+		// Logging is switched only when the rest of the config is applied
+		if err = p.proxy.Update(cfg); err == nil {
+			p.accessLog.setConfig(cfg.AccessLog)
+			p.admin.setConfig(cfg.Admin)
+			if lerr := config.SetupLogging(cfg); lerr != nil {
+				err = errors.Wrap(lerr, "Config is applied, but the log outputs are kept")
+			}
+		}
+		recordReload(err)
+		p.reloads.add(start, err)
 		if err != nil {
 			log.Error(err)
 			w.WriteHeader(http.StatusBadRequest)
@@ -87,22 +186,61 @@ func (p *ProxyServer) setupServerShutdown() {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		// Disable ongoing keep-alive connections
-		p.server.SetKeepAlivesEnabled(false)
-		if err := p.server.Shutdown(ctx); err != nil {
-			log.Fatalf("Could not shutdown the server: %s\n", err)
+		var wg sync.WaitGroup
+		for _, l := range p.listeners {
+			wg.Add(1)
+			go func(l *listener) {
+				defer wg.Done()
+				if err := l.shutdown(ctx); err != nil {
+					log.Errorf("Could not shutdown the %s listener gracefully: %s\n", l.cfg.Name, err)
+				}
+			}(l)
+		}
+		wg.Wait()
+
+		if err := p.proxy.tracer.shutdown(ctx); err != nil {
+			log.Errorf("Could not export the remaining spans: %s", err)
 		}
 	}()
 }
 
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (p *ProxyServer) Start() {
+	// Bind all the addresses first, so the misconfigured listener does not leave the others running
+	for _, l := range p.listeners {
+		if err := l.bind(); err != nil {
+			log.Fatalf("Can not start the %s listener: %s\n", l.cfg.Name, err)
+		}
+	}
+
 	p.setupServerShutdown()
 	p.setServerHealth(true)
 
-	err := p.server.ListenAndServe()
-	if err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Unexpected server error: %s\n", err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go p.watchCertificates(hup)
+
+	var wg sync.WaitGroup
+	for _, l := range p.listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			log.Warnf("Starting the %s listener on %s://%s\n", l.cfg.Name, l.cfg.Network, l.cfg.Address)
+			err := l.serve()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Unexpected server error: %s\n", err)
+			}
+		}(l)
 	}
+	wg.Wait()
 
 	// Wait until shutdown is finished
 	<-p.done
@@ -112,7 +250,6 @@ func getServer(cfg *config.Config, router *http.ServeMux, middlewares ...Middlew
 	// TODO: check other timeouts (header, idle, etc.)
 	// TODO: Headers/Body size limit?
 	server := &http.Server{
-		Addr:        fmt.Sprintf(":%d", cfg.Port),
 		Handler:     applyMiddlewares(router, middlewares),
 		ReadTimeout: time.Duration(cfg.ServerReadTimeout) * time.Second,
 		// TODO: check correct value for this field https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
@@ -122,25 +259,122 @@ func getServer(cfg *config.Config, router *http.ServeMux, middlewares ...Middlew
 	return server, nil
 }
 
+// setupH2C enables HTTP/2 over cleartext, HTTP/1 stays available for the other clients
+func setupH2C(server *http.Server, lc config.Listener) {
+	switch lc.H2C {
+	case config.H2CPriorKnowledge:
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		server.Protocols = &protocols
+	case config.H2CUpgrade:
+		// net/http does not implement the upgrade, the handler takes over the upgraded and prior knowledge connections
+		server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+	}
+}
+
+// getRedirectListener creates plain HTTP companion of the https listener
+// that redirects the clients to https and serves the exception paths with the https listener routes
+func getRedirectListener(cfg *config.Config, https *listener, middlewares []Middleware) (*listener, error) {
+	rc := config.Listener{
+		Name:     https.cfg.Name + "-redirect",
+		Network:  "tcp",
+		Address:  https.cfg.Redirect.Address,
+		Protocol: config.HTTPProtocol,
+	}
+	l := &listener{cfg: rc, router: http.NewServeMux()}
+	l.router.Handle("/", httpsRedirect(https.cfg.Redirect, https.cfg.Address, https.router))
+
+	server, err := getServer(cfg, l.router, middlewares...)
+	if err != nil {
+		return nil, err
+	}
+	l.server = server
+	return l, nil
+}
+
+// middlewares are shared by all the http listeners
+func (p *ProxyServer) middlewares() []Middleware {
+	// Client IP goes first, as the request ID can be trusted only from the trusted proxies
+	// Access log goes after the request ID and the client IP are known
+	// It is installed even when disabled, so it can be enabled on reload
+	return []Middleware{realIP(p.proxy), tracing(p.proxy), accessLogging(p.accessLog), traceRequests(p.proxy.tracer)}
+}
+
 func NewProxyServer(cfg *config.Config) (*ProxyServer, error) {
-	p := ProxyServer{done: make(chan bool)}
+	p := ProxyServer{done: make(chan bool), reloads: &reloadHistory{}}
 
 	proxy, err := NewProxy(cfg)
 	if err != nil {
 		return nil, err
 	}
 	p.proxy = proxy
+	p.accessLog = newAccessLogger(cfg.AccessLog, config.AccessLogWriter())
+	p.admin = newAdminGuard(cfg.Admin, config.AuditLogWriter())
+	p.started = cfg
+
+	for _, lc := range cfg.Listeners {
+		if lc.Protocol == config.UDPProtocol {
+			p.listeners = append(p.listeners, &listener{cfg: lc, udp: newUDPProxy(lc.Name, lc.Stream, p.proxy)})
+			continue
+		}
+		if lc.Protocol == config.TCPProtocol {
+			p.listeners = append(p.listeners, &listener{cfg: lc, tcp: newTCPProxy(lc.Name, lc.Stream, p.proxy)})
+			continue
+		}
 
-	p.router = http.NewServeMux()
-	// TODO: use TimeoutHandler for timeouts for the overall flow?
-	p.router.HandleFunc("/", p.proxy.Handle)
-	p.router.HandleFunc("/-/health", p.healthHandler())
-	p.router.HandleFunc("/-/reload", p.reloadHandler())
+		l := &listener{cfg: lc, router: http.NewServeMux()}
+		// TODO: use TimeoutHandler for timeouts for the overall flow?
+		l.router.HandleFunc("/", p.proxy.Handler(lc.Name))
+		l.router.HandleFunc("/-/health", p.healthHandler())
+		l.router.HandleFunc("/-/ready", p.readyHandler())
+		// Admin endpoints are not exposed with the proxied traffic when the admin listener is set
+		if cfg.Admin == nil || cfg.Admin.Address == "" {
+			l.router.HandleFunc("/-/reload", p.admin.protect("reload", true, p.reloadHandler()))
+			l.router.HandleFunc("/-/metrics", p.admin.protect("metrics", false, p.proxy.metricsHandler()))
+		}
 
-	server, err := getServer(cfg, p.router, tracing)
-	if err != nil {
-		return nil, err
+		middlewares := p.middlewares()
+		if lc.HSTS != nil {
+			middlewares = append(middlewares, hsts(lc.HSTS))
+		}
+		server, err := getServer(cfg, l.router, middlewares...)
+		if err != nil {
+			return nil, err
+		}
+		l.server = server
+
+		setupH2C(l.server, lc)
+
+		if lc.TLS != nil {
+			store, err := newCertStore(lc.TLS)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Can not configure TLS for the %s listener", lc.Name)
+			}
+			l.certs = store
+			l.server.TLSConfig = getTLSConfig(lc.TLS, store)
+			if !containsString(lc.TLS.ALPN, "h2") {
+				// Non-nil map disables the automatic HTTP/2 setup
+				l.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+			}
+		}
+		p.listeners = append(p.listeners, l)
+
+		if lc.Redirect != nil {
+			rl, err := getRedirectListener(cfg, l, p.middlewares())
+			if err != nil {
+				return nil, err
+			}
+			p.listeners = append(p.listeners, rl)
+		}
+	}
+
+	if cfg.Admin != nil && cfg.Admin.Address != "" {
+		al, err := p.getAdminListener(cfg)
+		if err != nil {
+			return nil, err
+		}
+		p.listeners = append(p.listeners, al)
 	}
-	p.server = server
 	return &p, nil
 }
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestSetupH2C(t *testing.T) {
+	tests := []struct {
+		name     string
+		listener config.Listener
+		// priorKnowledge and upgrade report whether HTTP/2 is used by such clients
+		priorKnowledge bool
+		upgrade        bool
+	}{
+		{name: "disabled", listener: config.Listener{}},
+		{name: "prior knowledge", listener: config.Listener{H2C: config.H2CPriorKnowledge}, priorKnowledge: true},
+		{name: "upgrade", listener: config.Listener{H2C: config.H2CUpgrade}, priorKnowledge: true, upgrade: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			}))
+			setupH2C(ts.Config, tt.listener)
+			ts.Start()
+			defer ts.Close()
+
+			// Prior knowledge client starts with the HTTP/2 preface
+			var protocols http.Protocols
+			protocols.SetUnencryptedHTTP2(true)
+			client := &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if got := err == nil && resp.ProtoMajor == 2; got != tt.priorKnowledge {
+				t.Errorf("expected prior knowledge HTTP/2 %v, got %v (%v)", tt.priorKnowledge, got, err)
+			}
+
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQCAAAAAAIAAAAA\r\n\r\n"))
+			upgraded, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := upgraded.StatusCode == http.StatusSwitchingProtocols; got != tt.upgrade {
+				t.Errorf("expected upgrade %v, got status %d", tt.upgrade, upgraded.StatusCode)
+			}
+		})
+	}
+}
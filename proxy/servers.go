@@ -0,0 +1,326 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	activeState int32 = iota
+	drainingState
+	disabledState
+)
+
+var stateNames = map[int32]string{
+	activeState:   string(config.ActiveState),
+	drainingState: string(config.DrainingState),
+	disabledState: string(config.DisabledState),
+}
+
+func parseState(name string) (int32, error) {
+	st, err := config.GetServerState(name)
+	if err != nil {
+		return 0, err
+	}
+	for v, n := range stateNames {
+		if n == string(st) {
+			return v, nil
+		}
+	}
+	return 0, errors.Errorf("Unknown server state %s", name)
+}
+
+func (s *server) getState() int32 {
+	return atomic.LoadInt32(&s.state)
+}
+
+func (s *server) getWeight() int {
+	return int(atomic.LoadInt32(&s.weight))
+}
+
+// isAvailable reports whether the server can receive the new requests
+func (s *server) isAvailable() bool {
+	return s.isHealthy() && s.getState() == activeState
+}
+
+// statusError is the error of the admin API request with the HTTP status of the response
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func newStatusError(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// serverChange is the request of the admin API to change the server
+type serverChange struct {
+	// URL is the server address in the same form as in the config file
+	URL      string  `json:"url"`
+	Priority int     `json:"priority"`
+	Weight   *int    `json:"weight"`
+	State    *string `json:"state"`
+}
+
+// serverKey returns the normalized server URL used to identify the server
+func serverKey(address string) (string, error) {
+	u, err := config.ParseServer(address)
+	if err != nil {
+		return "", newStatusError(http.StatusBadRequest, "%s", err)
+	}
+	return newServer(*u).String(), nil
+}
+
+func findServer(servers []*server, key string) (int, *server) {
+	for i, s := range servers {
+		if s.String() == key {
+			return i, s
+		}
+	}
+	return -1, nil
+}
+
+// applyChange sets the state and weight of the server and records them in the override
+// All the fields are validated first, so the invalid change leaves the server as it was
+func applyChange(s *server, change serverChange, override *config.ServerOverride) error {
+	var st int32
+	if change.State != nil {
+		var err error
+		if st, err = parseState(*change.State); err != nil {
+			return newStatusError(http.StatusBadRequest, "%s", err)
+		}
+	}
+	if w := change.Weight; w != nil && (*w < 1 || *w > config.MaxWeight) {
+		return newStatusError(http.StatusBadRequest, "Server weight should be between 1 and %d", config.MaxWeight)
+	}
+
+	if change.State != nil {
+		atomic.StoreInt32(&s.state, st)
+		override.State, _ = config.GetServerState(*change.State)
+	}
+	if change.Weight != nil {
+		atomic.StoreInt32(&s.weight, int32(*change.Weight))
+		override.Weight = *change.Weight
+	}
+	return nil
+}
+
+// applyOverlay changes the servers of the upstreams created from the config file
+// Entries that do not match the config any more are skipped
+func applyOverlay(cfg *config.Config, upstreams []*upstream, o *config.Overlay) {
+	for _, cu := range cfg.Upstreams {
+		uo, ok := o.Upstreams[cu.Name]
+		if !ok {
+			continue
+		}
+		var u *upstream
+		for _, v := range upstreams {
+			if v.name == cu.Name {
+				u = v
+			}
+		}
+
+		var servers []*server
+		current, _ := u.pool()
+		for _, s := range current {
+			if !containsString(uo.Removed, s.String()) {
+				servers = append(servers, s)
+			}
+		}
+		for _, fs := range uo.Added {
+			su, err := config.ParseServer(fs.URL)
+			if err == nil && su.Scheme != "unix" {
+				err = cu.CheckServer(*su)
+			}
+			if err != nil {
+				log.Warnf("Server %s added to upstream %s at runtime is skipped: %s", fs.URL, cu.Name, err)
+				continue
+			}
+			s := newServer(*su)
+			if i, _ := findServer(servers, s.String()); i >= 0 {
+				continue
+			}
+			s.priority = fs.Priority
+			if w, err := config.ValidateWeight(fs.Weight); err == nil {
+				s.weight = int32(w)
+			}
+			servers = append(servers, s)
+		}
+		if len(servers) == 0 {
+			log.Warnf("Runtime changes of upstream %s are skipped, as it would have no servers", cu.Name)
+			continue
+		}
+
+		for key, ov := range uo.Overrides {
+			_, s := findServer(servers, key)
+			if s == nil {
+				continue
+			}
+			if st, err := parseState(string(ov.State)); err == nil {
+				s.state = st
+			}
+			if ov.Weight > 0 && ov.Weight <= config.MaxWeight {
+				s.weight = int32(ov.Weight)
+			}
+		}
+		u.setPool(servers)
+	}
+}
+
+// saveOverlay persists the runtime changes when the overlay file is configured
+func (p *Proxy) saveOverlay() error {
+	if p.overlayPath == "" {
+		return nil
+	}
+	if err := config.WriteOverlay(p.overlayPath, p.overlay); err != nil {
+		log.Error(err)
+		return newStatusError(http.StatusInternalServerError, "Server change is applied, but not saved: %s", err)
+	}
+	return nil
+}
+
+func (p *Proxy) managedUpstream(name string) (*upstream, config.Upstr, error) {
+	u, err := p.getNamedUpstream(name)
+	if err != nil {
+		return nil, config.Upstr{}, newStatusError(http.StatusNotFound, "Unknown upstream %s", name)
+	}
+	for _, cu := range p.getConfig().Upstreams {
+		if cu.Name == name {
+			return u, cu, nil
+		}
+	}
+	return nil, config.Upstr{}, newStatusError(http.StatusNotFound, "Unknown upstream %s", name)
+}
+
+// addServer adds the server to the upstream, it receives the requests right away unless the state says otherwise
+func (p *Proxy) addServer(name string, change serverChange) (*upstream, error) {
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+
+	u, cu, err := p.managedUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	su, err := config.ParseServer(change.URL)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadRequest, "%s", err)
+	}
+	// The transport knows only about the sockets from the config file
+	if su.Scheme == "unix" {
+		return nil, newStatusError(http.StatusBadRequest, "Unix socket servers can be added only in the config file")
+	}
+	if err := cu.CheckServer(*su); err != nil {
+		return nil, newStatusError(http.StatusBadRequest, "%s", err)
+	}
+	if change.Priority < 0 {
+		return nil, newStatusError(http.StatusBadRequest, "Server priority should not be negative")
+	}
+
+	s := newServer(*su)
+	servers, _ := u.pool()
+	if i, _ := findServer(servers, s.String()); i >= 0 {
+		return nil, newStatusError(http.StatusConflict, "Server %s is already in upstream %s", s, name)
+	}
+	s.priority = change.Priority
+	var override config.ServerOverride
+	if err := applyChange(s, change, &override); err != nil {
+		return nil, err
+	}
+
+	u.setPool(append(append([]*server{}, servers...), s))
+	if u.healthCheck != nil {
+		go u.checkServer(s)
+	}
+	log.Warnf("Server %s is added to upstream %s", s, name)
+
+	uo := p.overlay.Upstream(name)
+	uo.Added = append(uo.Added, config.FileServer{URL: s.String(), Priority: s.priority, Weight: s.getWeight()})
+	if override.State != "" {
+		uo.Overrides[s.String()] = override
+	}
+	return u, p.saveOverlay()
+}
+
+// updateServer changes the state or the weight of the server
+// Draining server finishes the requests in flight and receives no new ones
+func (p *Proxy) updateServer(name, address string, change serverChange) (*upstream, error) {
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+
+	u, _, err := p.managedUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := serverKey(address)
+	if err != nil {
+		return nil, err
+	}
+	servers, _ := u.pool()
+	_, s := findServer(servers, key)
+	if s == nil {
+		return nil, newStatusError(http.StatusNotFound, "Unknown server %s in upstream %s", key, name)
+	}
+
+	uo := p.overlay.Upstream(name)
+	override := uo.Overrides[key]
+	if err := applyChange(s, change, &override); err != nil {
+		return nil, err
+	}
+	uo.Overrides[key] = override
+	log.Warnf("Server %s of upstream %s is %s with weight %d", s, name, stateNames[s.getState()], s.getWeight())
+	return u, p.saveOverlay()
+}
+
+// removeServer takes the server out of the upstream, the requests in flight are finished
+func (p *Proxy) removeServer(name, address string) (*upstream, error) {
+	p.overlayMu.Lock()
+	defer p.overlayMu.Unlock()
+
+	u, _, err := p.managedUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	key, err := serverKey(address)
+	if err != nil {
+		return nil, err
+	}
+	servers, _ := u.pool()
+	i, s := findServer(servers, key)
+	if s == nil {
+		return nil, newStatusError(http.StatusNotFound, "Unknown server %s in upstream %s", key, name)
+	}
+	if len(servers) == 1 {
+		return nil, newStatusError(http.StatusConflict, "Upstream %s should have at least one server", name)
+	}
+
+	rest := append(append([]*server{}, servers[:i]...), servers[i+1:]...)
+	u.setPool(rest)
+	close(s.stop)
+	log.Warnf("Server %s is removed from upstream %s", s, name)
+
+	uo := p.overlay.Upstream(name)
+	added := uo.Added[:0]
+	wasAdded := false
+	for _, fs := range uo.Added {
+		if k, err := serverKey(fs.URL); err == nil && k == key {
+			wasAdded = true
+			continue
+		}
+		added = append(added, fs)
+	}
+	uo.Added = added
+	if !wasAdded && !containsString(uo.Removed, key) {
+		uo.Removed = append(uo.Removed, key)
+	}
+	delete(uo.Overrides, key)
+	return u, p.saveOverlay()
+}
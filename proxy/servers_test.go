@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestApplyChange(t *testing.T) {
+	str := func(v string) *string { return &v }
+	num := func(v int) *int { return &v }
+
+	tests := []struct {
+		name   string
+		change serverChange
+		err    bool
+		state  int32
+		weight int
+		// override is the expected override after the change
+		override config.ServerOverride
+	}{
+		{
+			name:     "state and weight",
+			change:   serverChange{State: str("draining"), Weight: num(5)},
+			state:    drainingState,
+			weight:   5,
+			override: config.ServerOverride{State: config.DrainingState, Weight: 5},
+		},
+		{
+			name:     "only weight",
+			change:   serverChange{Weight: num(3)},
+			state:    activeState,
+			weight:   3,
+			override: config.ServerOverride{Weight: 3},
+		},
+		{
+			name:   "valid state with invalid weight",
+			change: serverChange{State: str("disabled"), Weight: num(0)},
+			err:    true,
+			state:  activeState,
+			weight: 1,
+		},
+		{
+			name:   "invalid state with valid weight",
+			change: serverChange{State: str("paused"), Weight: num(2)},
+			err:    true,
+			state:  activeState,
+			weight: 1,
+		},
+		{
+			name:   "weight above maximum",
+			change: serverChange{Weight: num(config.MaxWeight + 1)},
+			err:    true,
+			state:  activeState,
+			weight: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(url.URL{Scheme: "http", Host: "10.0.0.1:80"})
+			var override config.ServerOverride
+			err := applyChange(s, tt.change, &override)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if s.getState() != tt.state || s.getWeight() != tt.weight {
+				t.Errorf("expected state %d and weight %d, got %d and %d", tt.state, tt.weight, s.getState(), s.getWeight())
+			}
+			if override != tt.override {
+				t.Errorf("expected override %+v, got %+v", tt.override, override)
+			}
+		})
+	}
+}
+
+// testConfig reads the config from the yml source, relative paths in it are resolved against dir
+func testConfig(t *testing.T, dir, source string) *config.Config {
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestUpdateOverlayPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := func(overlay string) string {
+		return `
+listeners:
+  - name: web
+    address: 127.0.0.1:18080
+    routes: [api]
+upstreams:
+  api:
+    servers: [10.0.0.1:80, 10.0.0.2:80]
+    condition: {type: prefix, value: /}
+admin:
+  address: 127.0.0.1:19000
+  tokens: {deploy: 0123456789abcdef0123}
+  overlay: ` + filepath.Join(dir, overlay)
+	}
+
+	p, err := NewProxy(testConfig(t, dir, source("first.yml")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := "draining"
+	if _, err := p.updateServer("api", "http://10.0.0.1:80", serverChange{State: &state}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Update(testConfig(t, dir, source("second.yml"))); err != nil {
+		t.Fatal(err)
+	}
+	// New overlay file is empty, so the server is active again
+	u, _ := p.getNamedUpstream("api")
+	servers, _ := u.pool()
+	if servers[0].getState() != activeState {
+		t.Errorf("expected the overlay of the new file to be applied")
+	}
+	if _, err := p.updateServer("api", "http://10.0.0.2:80", serverChange{State: &state}); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, server := range map[string]string{"first.yml": "http://10.0.0.1:80", "second.yml": "http://10.0.0.2:80"} {
+		o, err := config.ReadOverlay(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		overrides := o.Upstream("api").Overrides
+		if len(overrides) != 1 || overrides[server].State != config.DrainingState {
+			t.Errorf("%s: expected only %s to be draining, got %+v", file, server, overrides)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpProxy forwards the accepted connections to the servers of the single upstream
+type tcpProxy struct {
+	name  string
+	cfg   *config.Stream
+	proxy *Proxy
+
+	// active is the number of the connections being proxied
+	active int64
+
+	mu      sync.Mutex
+	ln      net.Listener
+	closing bool
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+func newTCPProxy(name string, cfg *config.Stream, proxy *Proxy) *tcpProxy {
+	return &tcpProxy{name: name, cfg: cfg, proxy: proxy, conns: make(map[net.Conn]struct{})}
+}
+
+// idleConn extends the deadline on every read and write, so only the inactive connections are closed
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// addConn registers the connection to be closed on forced shutdown
+func (t *tcpProxy) addConn(c net.Conn, session bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	if session {
+		t.wg.Add(1)
+		atomic.AddInt64(&t.active, 1)
+		streamActive.add(1, t.name, "tcp")
+	}
+	return true
+}
+
+func (t *tcpProxy) removeConn(c net.Conn, session bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+	if session {
+		t.wg.Done()
+		atomic.AddInt64(&t.active, -1)
+		streamActive.add(-1, t.name, "tcp")
+	}
+}
+
+func (t *tcpProxy) serve(ln net.Listener) error {
+	t.mu.Lock()
+	t.ln = ln
+	t.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.mu.Lock()
+			closing := t.closing
+			t.mu.Unlock()
+			if closing {
+				return nil
+			}
+			// Accept errors like EMFILE are usually temporary, so keep serving
+			log.Errorf("[TCP:%s] Can not accept connection: %s", t.name, err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		streamConnections.inc(t.name, "tcp")
+		if !t.addConn(conn, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer t.removeConn(conn, true)
+			t.handle(conn)
+		}()
+	}
+}
+
+// dial connects to the server of the upstream
+// When the connection fails, the next available server is tried, every server is tried once
+func (t *tcpProxy) dial(u *upstream) (net.Conn, *server, error) {
+	tried := make(map[*server]bool)
+	var lastErr error
+	for {
+		s, err := u.nextServer(tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, nil, lastErr
+			}
+			return nil, nil, errors.Wrapf(err, "Can not get server for upstream %s", u.name)
+		}
+		if lastErr != nil {
+			log.Warnf("[TCP:%s] %s, trying %s", t.name, lastErr, s.address())
+			upstreamRetries.inc(u.name)
+		}
+		tried[s] = true
+
+		conn, err := net.DialTimeout(s.network(), s.address(), t.cfg.ConnectTimeout)
+		if err == nil {
+			return conn, s, nil
+		}
+		lastErr = errors.Wrapf(err, "Can not connect to %s", s.address())
+	}
+}
+
+// closeWrite signals the end of the data to the other side and keeps the connection open for reading
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+func (t *tcpProxy) handle(client net.Conn) {
+	defer client.Close()
+	start := time.Now()
+
+	u, err := t.proxy.getNamedUpstream(t.cfg.Upstream)
+	if err != nil {
+		log.Errorf("[TCP:%s] %s : %s", t.name, client.RemoteAddr(), err)
+		return
+	}
+	backend, s, err := t.dial(u.target())
+	if err != nil {
+		log.Errorf("[TCP:%s] %s : %s", t.name, client.RemoteAddr(), err)
+		return
+	}
+	defer backend.Close()
+	defer s.acquire()()
+
+	// Make the backend connection visible for the forced shutdown
+	if !t.addConn(backend, false) {
+		return
+	}
+	defer t.removeConn(backend, false)
+
+	if t.cfg.SendProxyProtocol != 0 {
+		header := proxyHeader(t.cfg.SendProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+		if _, err := backend.Write(header); err != nil {
+			log.Errorf("[TCP:%s] %s : Can not send PROXY header to %s: %s", t.name, client.RemoteAddr(), s.address(), err)
+			return
+		}
+	}
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(&idleConn{Conn: backend, timeout: t.cfg.IdleTimeout}, &idleConn{Conn: client, timeout: t.cfg.IdleTimeout})
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(&idleConn{Conn: client, timeout: t.cfg.IdleTimeout}, &idleConn{Conn: backend, timeout: t.cfg.IdleTimeout})
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	log.Infof("[TCP:%s] %s -> %s, %d bytes sent, %d bytes received, %s", t.name, client.RemoteAddr(), s.address(), sent, received, time.Since(start))
+}
+
+// shutdown stops accepting new connections and waits for the active ones to finish
+// Connections that are still open when the context is done are closed forcibly
+func (t *tcpProxy) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	if t.ln != nil {
+		t.ln.Close()
+	}
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	active := atomic.LoadInt64(&t.active)
+	t.mu.Lock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	<-done
+	return errors.Errorf("%d connections were closed forcibly", active)
+}
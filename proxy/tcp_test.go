@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+// closedAddress returns the local address nothing listens on
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestTCPDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	live := ln.Addr().String()
+
+	tests := []struct {
+		name      string
+		addresses []string
+		// server is the expected server, empty when dial fails
+		server string
+	}{
+		{name: "first server", addresses: []string{live}, server: live},
+		{name: "failed server is skipped", addresses: []string{closedAddress(t), live}, server: live},
+		{name: "several failed servers", addresses: []string{closedAddress(t), closedAddress(t), live}, server: live},
+		{name: "all servers fail", addresses: []string{closedAddress(t), closedAddress(t)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTCPProxy("tcp", &config.Stream{ConnectTimeout: time.Second}, nil)
+			conn, s, err := tp.dial(testUpstream("api", nil, tt.addresses...))
+			if tt.server == "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("expected error, connected to %s", s.address())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if s.address() != tt.server {
+				t.Errorf("expected server %s, got %s", tt.server, s.address())
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// certWatchInterval is how often certificate files are checked for changes
+const certWatchInterval = 10 * time.Second
+
+// certStore keeps the listener certificates and selects one of them by SNI
+// Certificates can be reloaded at runtime, the ongoing handshakes keep using the previous ones
+type certStore struct {
+	pairs []config.CertPair
+	// clientCA is optional path to the bundle used to verify client certificates
+	clientCA string
+
+	mu        sync.RWMutex
+	certs     []*tls.Certificate
+	clientCAs *x509.CertPool
+	mtimes    map[string]time.Time
+}
+
+func newCertStore(cfg *config.TLS) (*certStore, error) {
+	cs := &certStore{pairs: cfg.Certificates, clientCA: cfg.ClientCA}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) files() []string {
+	files := make([]string, 0, 2*len(cs.pairs)+1)
+	for _, p := range cs.pairs {
+		files = append(files, p.CertFile, p.KeyFile)
+	}
+	if cs.clientCA != "" {
+		files = append(files, cs.clientCA)
+	}
+	return files
+}
+
+func fileMTimes(files []string) map[string]time.Time {
+	mtimes := make(map[string]time.Time, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			mtimes[f] = fi.ModTime()
+		}
+	}
+	return mtimes
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can not read CA bundle %s", path)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// load reads all the certificates from disk
+// Certificates are replaced only if all of them were loaded successfully
+func (cs *certStore) load() error {
+	mtimes := fileMTimes(cs.files())
+	certs := make([]*tls.Certificate, 0, len(cs.pairs))
+	for _, p := range cs.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return errors.Wrapf(err, "Can not load certificate %s", p.CertFile)
+		}
+		certs = append(certs, &cert)
+	}
+
+	var pool *x509.CertPool
+	if cs.clientCA != "" {
+		var err error
+		if pool, err = loadCertPool(cs.clientCA); err != nil {
+			return err
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.certs = certs
+	cs.clientCAs = pool
+	cs.mtimes = mtimes
+	return nil
+}
+
+// changed reports whether any of the certificate files were modified since the last load
+func (cs *certStore) changed() bool {
+	mtimes := fileMTimes(cs.files())
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for f, t := range mtimes {
+		if !cs.mtimes[f].Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+// The first certificate that is valid for the requested server name is used, the first configured certificate otherwise
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	if len(cs.certs) == 0 {
+		return nil, errors.New("No certificates loaded")
+	}
+	if hello.ServerName != "" {
+		for _, c := range cs.certs {
+			if hello.SupportsCertificate(c) == nil {
+				return c, nil
+			}
+		}
+	}
+	return cs.certs[0], nil
+}
+
+func getTLSConfig(cfg *config.TLS, store *certStore) *tls.Config {
+	tc := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     cfg.MinVersion,
+		CipherSuites:   cfg.CipherSuites,
+		NextProtos:     cfg.ALPN,
+		ClientAuth:     cfg.ClientAuth,
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		// Config is built per handshake to pick up the reloaded CA bundle
+		base := tc.Clone()
+		tc.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			store.mu.RLock()
+			c.ClientCAs = store.clientCAs
+			store.mu.RUnlock()
+			return c, nil
+		}
+	}
+	return tc
+}
+
+// reloadCertificates reloads the certificates of all https listeners
+// When force is false only the stores with modified files are reloaded
+func (p *ProxyServer) reloadCertificates(force bool) {
+	for _, l := range p.listeners {
+		if l.certs == nil || (!force && !l.certs.changed()) {
+			continue
+		}
+		if err := l.certs.load(); err != nil {
+			log.Errorf("Can not reload certificates for the %s listener: %s", l.cfg.Name, err)
+			continue
+		}
+		log.Warnf("Certificates for the %s listener were reloaded", l.cfg.Name)
+	}
+}
+
+// watchCertificates reloads the certificates on SIGHUP or when the files are changed
+func (p *ProxyServer) watchCertificates(hup <-chan os.Signal) {
+	ticker := time.NewTicker(certWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+			p.reloadCertificates(true)
+		case <-ticker.C:
+			p.reloadCertificates(false)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Headers with the verified client certificate details passed to the upstreams
+var clientCertHeaders = []string{
+	"X-Client-Cert-Subject",
+	"X-Client-Cert-SAN",
+	"X-Client-Cert-Fingerprint",
+}
+
+// setClientCertHeaders passes the identity of the verified client certificate to the upstream
+// Values sent by the client are always removed, so the upstream can trust the headers
+func setClientCertHeaders(fwd *http.Request) {
+	for _, h := range clientCertHeaders {
+		fwd.Header.Del(h)
+	}
+	cert := config.ClientCertificate(fwd)
+	if cert == nil {
+		return
+	}
+	fwd.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	if sans := config.CertSANs(cert); len(sans) != 0 {
+		fwd.Header.Set("X-Client-Cert-SAN", strings.Join(sans, ","))
+	}
+	fwd.Header.Set("X-Client-Cert-Fingerprint", config.CertFingerprint(cert))
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+// writeTestCert writes the self-signed certificate for the names into dir
+func writeTestCert(t *testing.T, dir, name string, names ...string) config.CertPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pair := config.CertPair{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(pair.CertFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.KeyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func certName(t *testing.T, c *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cs, err := newCertStore(&config.TLS{Certificates: []config.CertPair{
+		writeTestCert(t, dir, "default", "example.com"),
+		writeTestCert(t, dir, "api", "api.example.org"),
+		writeTestCert(t, dir, "wildcard", "*.example.net"),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "example.com", want: "example.com"},
+		{serverName: "api.example.org", want: "api.example.org"},
+		{serverName: "www.example.net", want: "*.example.net"},
+		{serverName: "unknown.test", want: "example.com"},
+		{serverName: "", want: "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			hello := &tls.ClientHelloInfo{
+				ServerName:        tt.serverName,
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13},
+			}
+			c, err := cs.GetCertificate(hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := certName(t, c); got != tt.want {
+				t.Errorf("expected certificate %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair := writeTestCert(t, dir, "site", "old.example.com")
+	cs, err := newCertStore(&config.TLS{Certificates: []config.CertPair{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.changed() {
+		t.Fatal("certificates should not be changed right after the load")
+	}
+
+	writeTestCert(t, dir, "site", "new.example.com")
+	// Modification time resolution of some file systems is too coarse to notice the rewrite
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, future, future)
+	if !cs.changed() {
+		t.Fatal("rewritten certificate should be noticed")
+	}
+	if err := cs.load(); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := cs.GetCertificate(&tls.ClientHelloInfo{})
+	if got := certName(t, c); got != "new.example.com" {
+		t.Errorf("expected reloaded certificate, got %s", got)
+	}
+
+	// Broken files keep the previous certificates
+	ioutil.WriteFile(pair.KeyFile, []byte("broken"), 0600)
+	if err := cs.load(); err == nil {
+		t.Fatal("expected an error for the broken key")
+	}
+	c, _ = cs.GetCertificate(&tls.ClientHelloInfo{})
+	if got := certName(t, c); got != "new.example.com" {
+		t.Errorf("expected previous certificate to be kept, got %s", got)
+	}
+}
@@ -0,0 +1,419 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Trace context is propagated as described in https://www.w3.org/TR/trace-context/
+// Spans are exported with OTLP/HTTP JSON encoding, see https://opentelemetry.io/docs/specs/otlp/
+
+const (
+	serverSpanKind = 2
+	clientSpanKind = 3
+
+	spanStatusError = 2
+
+	// spanQueueSize limits the memory used by the spans waiting for export, new spans are dropped when it is full
+	spanQueueSize = 4096
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	state   string
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent accepts the version 00 header and the future versions with the same prefix
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return sc, false
+	}
+	// Uppercase hex is not allowed by the spec
+	if strings.ToLower(v) != v || isZero(traceID) || isZero(spanID) {
+		return sc, false
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+type span struct {
+	tracer *tracer
+	ctx    spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	// errMsg is set when the span failed
+	errMsg string
+	failed bool
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.failed, s.errMsg = true, msg
+}
+
+// finish queues the sampled span for export
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.ctx.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+func getSpan(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey).(*span)
+	return s
+}
+
+// tracer creates the spans and exports them in batches
+type tracer struct {
+	mu sync.RWMutex
+	// cfg is nil when tracing is disabled
+	cfg    *config.Tracing
+	client *http.Client
+
+	queue chan *span
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newTracer(cfg *config.Tracing) *tracer {
+	t := &tracer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *span, spanQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) setConfig(cfg *config.Tracing) {
+	t.mu.Lock()
+	t.cfg = cfg
+	t.mu.Unlock()
+}
+
+func (t *tracer) getConfig() *config.Tracing {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cfg
+}
+
+func randomID(b []byte) {
+	for {
+		rand.Read(b)
+		if !isZero(b) {
+			return
+		}
+	}
+}
+
+// shouldSample uses the trace ID, so every balancer with the same ratio makes the same decision
+func shouldSample(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(traceID[8:]) < uint64(ratio*math.MaxUint64)
+}
+
+func (t *tracer) newSpan(cfg *config.Tracing, parent *spanContext, name string, kind int) *span {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent != nil {
+		s.ctx.traceID, s.ctx.sampled, s.ctx.state = parent.traceID, parent.sampled, parent.state
+		s.parent = parent.spanID
+	} else {
+		randomID(s.ctx.traceID[:])
+		s.ctx.sampled = shouldSample(s.ctx.traceID, cfg.SampleRatio)
+	}
+	randomID(s.ctx.spanID[:])
+	return s
+}
+
+// startServerSpan continues the trace of the request or starts the new one
+// It returns nil when tracing is disabled
+func (t *tracer) startServerSpan(r *http.Request) *span {
+	cfg := t.getConfig()
+	if cfg == nil {
+		return nil
+	}
+	var parent *spanContext
+	if sc, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+		sc.state = strings.Join(r.Header["Tracestate"], ",")
+		parent = &sc
+	}
+	return t.newSpan(cfg, parent, r.Method, serverSpanKind)
+}
+
+// startClientSpan starts the span of the upstream attempt and sets the trace headers of the request
+// It returns nil when the request is not traced
+func (t *tracer) startClientSpan(fwd *http.Request) *span {
+	parent := getSpan(fwd.Context())
+	cfg := t.getConfig()
+	if parent == nil || cfg == nil {
+		return nil
+	}
+	s := t.newSpan(cfg, &parent.ctx, fwd.Method, clientSpanKind)
+	fwd.Header.Set("Traceparent", s.ctx.traceparent())
+	if s.ctx.state != "" {
+		fwd.Header.Set("Tracestate", s.ctx.state)
+	} else {
+		fwd.Header.Del("Tracestate")
+	}
+	return s
+}
+
+func (t *tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		log.Warnf("Span queue is full, span %x is dropped", s.ctx.spanID)
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	lastFlush := time.Now()
+	flush := func() {
+		if len(batch) != 0 {
+			if err := t.export(batch); err != nil {
+				log.Errorf("Can not export %d spans: %s", len(batch), err)
+			}
+		}
+		batch, lastFlush = nil, time.Now()
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if cfg := t.getConfig(); cfg == nil || len(batch) >= cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if cfg := t.getConfig(); cfg == nil || time.Since(lastFlush) >= cfg.FlushInterval {
+				flush()
+			}
+		case <-t.stop:
+			// Spans finished before the shutdown are exported
+			for len(t.queue) != 0 {
+				batch = append(batch, <-t.queue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// shutdown exports the queued spans
+func (t *tracer) shutdown(ctx context.Context) error {
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch value := v.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case string:
+		return map[string]interface{}{"stringValue": value}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
+
+func otlpAttributes(attrs []attribute) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		list = append(list, map[string]interface{}{"key": a.key, "value": otlpValue(a.value)})
+	}
+	return list
+}
+
+func otlpSpan(s *span) map[string]interface{} {
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.ctx.traceID[:]),
+		"spanId":            hex.EncodeToString(s.ctx.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if !isZero(s.parent[:]) {
+		m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.ctx.state != "" {
+		m["traceState"] = s.ctx.state
+	}
+	if s.failed {
+		m["status"] = map[string]interface{}{"code": spanStatusError, "message": s.errMsg}
+	}
+	return m
+}
+
+func (t *tracer) export(batch []*span) error {
+	cfg := t.getConfig()
+	if cfg == nil {
+		// Tracing was disabled on reload
+		return nil
+	}
+
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, otlpSpan(s))
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes([]attribute{{key: "service.name", value: cfg.ServiceName}}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "github.com/electroprovodka/loadbalancer"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "Can not encode spans")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Can not create export request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("Collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// traceRequests returns Middleware that records the server span of the request
+func traceRequests(t *tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := t.startServerSpan(r)
+			if s == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sw := &statusWriter{ResponseWriter: w}
+			r = r.WithContext(context.WithValue(r.Context(), spanKey, s))
+			defer func() {
+				if sw.status == 0 {
+					sw.status = http.StatusOK
+				}
+				ex := getExchange(r.Context())
+				s.setAttr("http.request.method", r.Method)
+				s.setAttr("url.path", r.URL.Path)
+				s.setAttr("server.address", r.Host)
+				s.setAttr("client.address", clientAddr(r))
+				s.setAttr("user_agent.original", r.UserAgent())
+				s.setAttr("http.response.status_code", sw.status)
+				s.setAttr("lb.request_id", GetRequestID(r.Context()))
+				if ex.listener != "" {
+					s.setAttr("lb.listener", ex.listener)
+					s.setAttr("lb.route", ex.route)
+					s.setAttr("lb.upstream", ex.upstream)
+				}
+				if sw.status >= 500 {
+					s.fail(ex.err)
+				}
+				s.finish()
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{name: "sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{name: "not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ok: true},
+		{name: "future version with extra field", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true, sampled: true},
+		{name: "version 00 with extra field", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{name: "forbidden version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01"},
+		{name: "zero trace id", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero span id", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "short trace id", value: "00-4bf92f3577b34da6-00f067aa0ba902b7-01"},
+		{name: "not hex", value: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01"},
+		{name: "empty", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := parseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, ok)
+			}
+			if ok && sc.sampled != tt.sampled {
+				t.Errorf("expected sampled %v, got %v", tt.sampled, sc.sampled)
+			}
+			if ok && tt.value[:2] == "00" && sc.traceparent() != tt.value {
+				t.Errorf("expected %s to be kept, got %s", tt.value, sc.traceparent())
+			}
+		})
+	}
+}
+
+// otlpRequest is the part of the OTLP/HTTP JSON export checked by the tests
+type otlpRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID      string `json:"traceId"`
+				SpanID       string `json:"spanId"`
+				ParentSpanID string `json:"parentSpanId"`
+				Kind         int    `json:"kind"`
+				TraceState   string `json:"traceState"`
+				Status       *struct {
+					Code int `json:"code"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+func TestTraceExport(t *testing.T) {
+	exports := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req otlpRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid export body %s: %s", body, err)
+		}
+		exports <- req
+	}))
+	defer collector.Close()
+
+	tr := newTracer(&config.Tracing{
+		Endpoint:      collector.URL,
+		ServiceName:   "lb",
+		SampleRatio:   1,
+		Headers:       map[string]string{"Authorization": "Bearer secret"},
+		FlushInterval: time.Hour,
+		BatchSize:     2,
+	})
+	defer tr.shutdown(context.Background())
+
+	var upstreamTraceparent string
+	handler := traceRequests(tr)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fwd := httptest.NewRequest(http.MethodGet, "http://10.0.0.1:8080/", nil).WithContext(r.Context())
+		s := tr.startClientSpan(fwd)
+		upstreamTraceparent = fwd.Header.Get("Traceparent")
+		s.finish()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Traceparent", parent)
+	r.Header.Set("Tracestate", "vendor=value")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var req otlpRequest
+	select {
+	case req = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spans were not exported")
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected client and server spans, got %d", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if client.Kind != clientSpanKind || server.Kind != serverSpanKind {
+		t.Fatalf("expected client span to finish first, got kinds %d and %d", client.Kind, server.Kind)
+	}
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || s.TraceState != "vendor=value" {
+			t.Errorf("expected the trace of the request, got %s %q", s.TraceID, s.TraceState)
+		}
+	}
+	if server.ParentSpanID != "00f067aa0ba902b7" || client.ParentSpanID != server.SpanID {
+		t.Errorf("expected the chain of parents, got server parent %s, client parent %s", server.ParentSpanID, client.ParentSpanID)
+	}
+	if server.Status == nil || server.Status.Code != spanStatusError {
+		t.Error("expected server span of 502 response to fail")
+	}
+	if !strings.Contains(upstreamTraceparent, "-"+client.SpanID+"-") {
+		t.Errorf("expected the client span in the upstream traceparent, got %s", upstreamTraceparent)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+)
+
+func getUpstreamTLSConfig(cfg *config.UpstreamTLS) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         cfg.ServerName,
+		MinVersion:         cfg.MinVersion,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can not load client certificate %s", cfg.CertFile)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// getUpstreamProtocols returns nil when the transport defaults should be used
+func getUpstreamProtocols(cu config.Upstr) *http.Protocols {
+	var protocols http.Protocols
+	switch cu.Protocol {
+	case config.HTTP1Protocol:
+		protocols.SetHTTP1(true)
+	case config.H2Protocol:
+		protocols.SetHTTP2(true)
+	case config.H2CProtocol:
+		// Prior knowledge, upstream should accept HTTP/2 without the upgrade
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	return &protocols
+}
+
+// socketHost is the placeholder host used in the request URLs for the unix socket server
+func socketHost(path string) string {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return "unix-" + strconv.FormatUint(h.Sum64(), 16)
+}
+
+// unixSockets maps the placeholder hosts to the socket paths
+func unixSockets(servers []url.URL) map[string]string {
+	sockets := make(map[string]string)
+	for _, s := range servers {
+		if s.Scheme == "unix" {
+			sockets[socketHost(s.Path)] = s.Path
+		}
+	}
+	return sockets
+}
+
+// dialUnixSockets makes the transport connect to the socket instead of the placeholder host
+func dialUnixSockets(transport *http.Transport, sockets map[string]string) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if path, ok := sockets[host]; ok {
+				return dialer.DialContext(ctx, "unix", path)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+
+	// Placeholder hosts should never go to the HTTP proxy from the environment
+	proxy := transport.Proxy
+	transport.Proxy = func(r *http.Request) (*url.URL, error) {
+		if _, ok := sockets[r.URL.Hostname()]; ok || proxy == nil {
+			return nil, nil
+		}
+		return proxy(r)
+	}
+}
+
+// getClient creates the client used for all the requests to the upstream servers
+func getClient(cu config.Upstr, timeout time.Duration) (*http.Client, error) {
+	// TODO: Read/Write buffers sizes
+	// TODO: setup more timeouts if needed https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cu.TLS != nil {
+		tc, err := getUpstreamTLSConfig(cu.TLS)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can not configure TLS for %s upstream", cu.Name)
+		}
+		transport.TLSClientConfig = tc
+	}
+	if protocols := getUpstreamProtocols(cu); protocols != nil {
+		transport.Protocols = protocols
+	}
+	if sockets := unixSockets(cu.Servers); len(sockets) != 0 {
+		dialUnixSockets(transport, sockets)
+	}
+
+	// TODO: build manual timeout with context?
+	client := &http.Client{
+		Transport: transport,
+		// NOTE: this timeout includes the response body read
+		Timeout: timeout,
+		// Redirects are passed to the client
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client, nil
+}
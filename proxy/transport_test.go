@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := writeTestCert(t, dir, "client", "lb.internal")
+
+	tests := []struct {
+		name    string
+		tls     config.UpstreamTLS
+		wantErr bool
+	}{
+		{name: "trusted server and client certificate", tls: config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile}},
+		{name: "server name override", tls: config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile, ServerName: "example.com"}},
+		{name: "server name mismatch", tls: config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile, ServerName: "other.test"}, wantErr: true},
+		{name: "unknown server CA", tls: config.UpstreamTLS{CertFile: client.CertFile, KeyFile: client.KeyFile}, wantErr: true},
+		{name: "skip verification", tls: config.UpstreamTLS{CertFile: client.CertFile, KeyFile: client.KeyFile, InsecureSkipVerify: true}},
+		{name: "no client certificate", tls: config.UpstreamTLS{CAFile: caFile}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamTLS := tt.tls
+			c, err := getClient(config.Upstr{Name: "api", TLS: &upstreamTLS}, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.Get(backend.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.wantErr && err == nil {
+				t.Error("expected the request to fail")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		tls  config.UpstreamTLS
+	}{
+		{name: "missing CA file", tls: config.UpstreamTLS{CAFile: "/nonexistent/ca.pem"}},
+		{name: "missing client certificate", tls: config.UpstreamTLS{CertFile: "/nonexistent/client.crt", KeyFile: "/nonexistent/client.key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamTLS := tt.tls
+			if _, err := getClient(config.Upstr{Name: "api", TLS: &upstreamTLS}, time.Second); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestUnixSocketUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sidecar := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && r.Host != "localhost" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte("unix " + r.Host))
+	})}
+	go sidecar.Serve(ln)
+	defer sidecar.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tcp"))
+	}))
+	defer backend.Close()
+
+	unixURL, err := config.ParseServer("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpURL, _ := url.Parse(backend.URL)
+	c, err := getClient(config.Upstr{Name: "sidecar", Servers: []url.URL{*unixURL, *tcpURL}}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &upstream{name: "sidecar", client: c, hostHeader: config.PreserveHost, stop: make(chan struct{})}
+
+	tests := []struct {
+		name   string
+		server *server
+		want   string
+	}{
+		{name: "unix socket server", server: newServer(*unixURL), want: "unix www.example.com"},
+		{name: "tcp server of the same upstream", server: newServer(*tcpURL), want: "tcp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.server.URL()+"/", nil)
+			req.Host = "www.example.com"
+			resp, err := u.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, body)
+			}
+		})
+	}
+
+	for _, hc := range []*config.HealthCheck{
+		{Type: config.HTTPHealthCheck, Path: "/health", Timeout: time.Second},
+		{Type: config.TCPHealthCheck, Timeout: time.Second},
+	} {
+		u.healthCheck = hc
+		if err := u.probe(newServer(*unixURL)); err != nil {
+			t.Errorf("%s health check of the unix socket server failed: %s", hc.Type, err)
+		}
+	}
+}
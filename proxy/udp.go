@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDatagramSize is the maximum size of UDP payload
+const maxDatagramSize = 64 * 1024
+
+// errUDPClosing is returned for the new clients while the listener is shutting down
+var errUDPClosing = errors.New("Listener is shutting down")
+
+// udpSession binds the client address to the upstream server
+// All the datagrams of the client go to the same server until the session expires
+type udpSession struct {
+	client  net.Addr
+	backend net.Conn
+	server  *server
+	// lastActive is the unix time in nanoseconds of the last datagram in any direction
+	lastActive int64
+
+	// mu is held for reading while the datagram is sent, so the session is not closed in the middle of the write
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// write sends the client datagram to the server, it returns false when the session is already closed
+func (s *udpSession) write(b []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false, nil
+	}
+	s.touch()
+	_, err := s.backend.Write(b)
+	return true, err
+}
+
+// expire closes the session when it was idle for the timeout
+// Datagrams sent concurrently extend the session, so their replies are not lost
+func (s *udpSession) expire(timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.idle() < timeout {
+		return false
+	}
+	s.closed = true
+	return true
+}
+
+func (s *udpSession) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *udpSession) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// udpProxy forwards the datagrams to the servers of the single upstream and relays the replies back
+type udpProxy struct {
+	name  string
+	cfg   *config.Stream
+	proxy *Proxy
+
+	mu       sync.Mutex
+	pc       net.PacketConn
+	closing  bool
+	sessions map[string]*udpSession
+	wg       sync.WaitGroup
+}
+
+func newUDPProxy(name string, cfg *config.Stream, proxy *Proxy) *udpProxy {
+	return &udpProxy{name: name, cfg: cfg, proxy: proxy, sessions: make(map[string]*udpSession)}
+}
+
+func (up *udpProxy) getSession(client net.Addr) (*udpSession, error) {
+	key := client.String()
+
+	up.mu.Lock()
+	if s, err := up.lookupSession(key); s != nil || err != nil {
+		up.mu.Unlock()
+		return s, err
+	}
+	srv, err := up.pickServer()
+	up.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Dial is done without the lock, other clients are served meanwhile
+	backend, err := net.Dial("udp", srv.address())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can not connect to %s", srv.address())
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	// Session could be created by the concurrent datagram from the same client while dialing
+	if s, err := up.lookupSession(key); s != nil || err != nil {
+		backend.Close()
+		return s, err
+	}
+	s := &udpSession{client: client, backend: backend, server: srv}
+	s.touch()
+	up.sessions[key] = s
+	streamConnections.inc(up.name, "udp")
+	streamActive.add(1, up.name, "udp")
+	up.wg.Add(1)
+	go up.relay(s)
+	return s, nil
+}
+
+// lookupSession returns the open session of the client or the reason why the new one can not be created,
+// both are nil when the session should be created. up.mu should be held
+func (up *udpProxy) lookupSession(key string) (*udpSession, error) {
+	// Closed session is replaced, it is removed from the map only when its relay is finished
+	if s, ok := up.sessions[key]; ok && !s.isClosed() {
+		return s, nil
+	}
+	if up.closing {
+		return nil, errUDPClosing
+	}
+	if _, replaced := up.sessions[key]; !replaced && up.cfg.MaxSessions > 0 && len(up.sessions) >= up.cfg.MaxSessions {
+		return nil, errors.Errorf("Too many sessions, the limit is %d", up.cfg.MaxSessions)
+	}
+	return nil, nil
+}
+
+func (up *udpProxy) pickServer() (*server, error) {
+	u, err := up.proxy.getNamedUpstream(up.cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	u = u.target()
+	srv, err := u.getServer()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can not get server for upstream %s", u.name)
+	}
+	return srv, nil
+}
+
+// relay sends the server replies to the client until the session expires
+func (up *udpProxy) relay(s *udpSession) {
+	defer up.wg.Done()
+	defer s.server.acquire()()
+	defer func() {
+		s.close()
+		up.mu.Lock()
+		if up.sessions[s.client.String()] == s {
+			delete(up.sessions, s.client.String())
+		}
+		up.mu.Unlock()
+		s.backend.Close()
+		streamActive.add(-1, up.name, "udp")
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		s.backend.SetReadDeadline(time.Now().Add(up.cfg.IdleTimeout))
+		n, err := s.backend.Read(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() && !s.expire(up.cfg.IdleTimeout) {
+				// Client was sending datagrams, but server was silent
+				continue
+			}
+			return
+		}
+		s.touch()
+		if _, err := up.pc.WriteTo(buf[:n], s.client); err != nil {
+			log.Errorf("[UDP:%s] Can not reply to %s: %s", up.name, s.client, err)
+		}
+	}
+}
+
+func (up *udpProxy) serve(pc net.PacketConn) error {
+	up.mu.Lock()
+	up.pc = pc
+	up.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			up.mu.Lock()
+			closing := up.closing
+			up.mu.Unlock()
+			if closing {
+				return nil
+			}
+			log.Errorf("[UDP:%s] Can not read datagram: %s", up.name, err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		up.forward(client, buf[:n])
+	}
+}
+
+// forward sends the datagram to the session server
+// Session might expire right before the write, then the new session is created
+func (up *udpProxy) forward(client net.Addr, b []byte) {
+	for {
+		s, err := up.getSession(client)
+		if err == errUDPClosing {
+			return
+		}
+		if err != nil {
+			log.Errorf("[UDP:%s] %s : %s", up.name, client, err)
+			return
+		}
+		sent, err := s.write(b)
+		if !sent {
+			continue
+		}
+		if err != nil {
+			log.Errorf("[UDP:%s] %s -> %s : %s", up.name, client, s.server.address(), err)
+		}
+		return
+	}
+}
+
+// shutdown stops creating the new sessions and waits for the active ones to expire
+// Sessions that are still open when the context is done are closed forcibly
+func (up *udpProxy) shutdown(ctx context.Context) error {
+	up.mu.Lock()
+	up.closing = true
+	up.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		up.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		up.mu.Lock()
+		err = errors.Errorf("%d sessions were closed forcibly", len(up.sessions))
+		for _, s := range up.sessions {
+			s.backend.Close()
+		}
+		up.mu.Unlock()
+		<-done
+	}
+
+	// Socket is kept open until now, so the replies of the active sessions reach the clients
+	up.mu.Lock()
+	if up.pc != nil {
+		up.pc.Close()
+	}
+	up.mu.Unlock()
+	return err
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/electroprovodka/loadbalancer/config"
+)
+
+// udpEcho starts the server that sends every datagram back
+func udpEcho(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// startUDPProxy serves the udp listener in front of the echo server
+func startUDPProxy(t *testing.T, cfg config.Stream) (*udpProxy, net.Addr, net.PacketConn) {
+	echo := udpEcho(t)
+	cfg.Upstream = "echo"
+	p := &Proxy{us: []*upstream{testUpstream("echo", nil, echo.LocalAddr().String())}}
+	up := newUDPProxy("udp", &cfg, p)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go up.serve(pc)
+	return up, pc.LocalAddr(), echo
+}
+
+func udpExchange(t *testing.T, addr net.Addr, msg string) (net.Conn, string) {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(msg))
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	return conn, string(buf[:n])
+}
+
+func (up *udpProxy) sessionCount() int {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return len(up.sessions)
+}
+
+func TestUDPMaxSessions(t *testing.T) {
+	up, addr, echo := startUDPProxy(t, config.Stream{IdleTimeout: time.Minute, MaxSessions: 1})
+	defer echo.Close()
+	defer up.shutdown(expiredContext())
+
+	first, reply := udpExchange(t, addr, "first")
+	defer first.Close()
+	if reply != "first" {
+		t.Fatalf("expected reply for the first client, got %q", reply)
+	}
+	second, reply := udpExchange(t, addr, "second")
+	defer second.Close()
+	if reply != "" {
+		t.Errorf("expected datagram above the limit to be dropped, got %q", reply)
+	}
+	if n := up.sessionCount(); n != 1 {
+		t.Errorf("expected 1 session, got %d", n)
+	}
+}
+
+func TestUDPConcurrentSession(t *testing.T) {
+	up, _, echo := startUDPProxy(t, config.Stream{IdleTimeout: time.Minute, MaxSessions: 1})
+	defer echo.Close()
+	defer up.shutdown(expiredContext())
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}
+	sessions := make([]*udpSession, 8)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := up.getSession(client)
+			if err != nil {
+				t.Error(err)
+			}
+			sessions[i] = s
+		}(i)
+	}
+	wg.Wait()
+	for _, s := range sessions[1:] {
+		if s != sessions[0] {
+			t.Fatal("expected the same session for every datagram of the client")
+		}
+	}
+	if n := up.sessionCount(); n != 1 {
+		t.Errorf("expected 1 session, got %d", n)
+	}
+}
+
+func TestUDPSessionExpire(t *testing.T) {
+	backend, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	s := &udpSession{backend: backend}
+
+	s.touch()
+	if s.expire(time.Hour) {
+		t.Fatal("active session should not expire")
+	}
+	if sent, _ := s.write([]byte("x")); !sent {
+		t.Fatal("datagram should be sent to the active session")
+	}
+	if !s.expire(0) {
+		t.Fatal("idle session should expire")
+	}
+	if sent, _ := s.write([]byte("x")); sent {
+		t.Error("datagram should not be sent to the expired session")
+	}
+}
+
+func expiredContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestUDPShutdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		idle  time.Duration
+		grace time.Duration
+		err   bool
+	}{
+		{name: "sessions expire before the grace period", idle: 200 * time.Millisecond, grace: 5 * time.Second},
+		{name: "sessions are closed after the grace period", idle: time.Minute, grace: 200 * time.Millisecond, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up, addr, echo := startUDPProxy(t, config.Stream{IdleTimeout: tt.idle, MaxSessions: 10})
+			defer echo.Close()
+			client, reply := udpExchange(t, addr, "before")
+			defer client.Close()
+			if reply != "before" {
+				t.Fatalf("expected reply, got %q", reply)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.grace)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- up.shutdown(ctx) }()
+
+			// Active session is still served, but the new clients are not
+			time.Sleep(50 * time.Millisecond)
+			client.Write([]byte("during"))
+			buf := make([]byte, 64)
+			client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, _ := client.Read(buf); string(buf[:n]) != "during" {
+				t.Errorf("expected reply during the shutdown, got %q", buf[:n])
+			}
+			other, reply := udpExchange(t, addr, "new")
+			defer other.Close()
+			if reply != "" {
+				t.Errorf("new client should not be served during the shutdown, got %q", reply)
+			}
+
+			if err := <-done; (err != nil) != tt.err {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if n := up.sessionCount(); n != 0 {
+				t.Errorf("expected no sessions, got %d", n)
+			}
+		})
+	}
+}